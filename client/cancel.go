@@ -11,6 +11,8 @@ type cancelCommand struct {
 	Args struct {
 		Id string `description:"UUID of the task to cancel" required:"true"`
 	} `positional-args:"true"`
+
+	Force bool `short:"f" long:"force" description:"Kill the task immediately, without sending it its stop signal and waiting for its grace period"`
 }
 
 func init() {
@@ -20,7 +22,7 @@ func init() {
 func (s *cancelCommand) Execute(args []string) error {
 	client := getClient()
 
-	_, err := client.Cancel(context.Background(), &api.TaskID{s.Args.Id})
+	_, err := client.Cancel(context.Background(), &api.CancelRequest{Id: &api.TaskID{s.Args.Id}, Force: s.Force})
 	if err != nil {
 		log.Fatalln("Error canceling task", err)
 	}
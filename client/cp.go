@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type cpCommand struct {
+	Args struct {
+		Source string `description:"File or directory to copy, as UUID:PATH" required:"true"`
+		Dest   string `description:"Local path to copy to, the source is copied into it if it's a directory" required:"true"`
+	} `positional-args:"true"`
+}
+
+func init() {
+	parser.AddCommand("cp", "Copy files out of a running task, or a finished task that kept its layer", "", &cpCommand{})
+}
+
+// createFile creates the local file name, and its parent directories
+func createFile(name string, mode uint32) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode)&os.ModePerm)
+}
+
+func (s *cpCommand) Execute(args []string) error {
+	client := getClient()
+
+	source := strings.SplitN(s.Args.Source, ":", 2)
+	if len(source) != 2 || !path.IsAbs(source[1]) {
+		log.Fatalln("Source must be UUID:PATH, PATH being absolute")
+	}
+	src := path.Clean(source[1])
+
+	// Copy into the destination if it's a directory, like cp
+	dest := s.Args.Dest
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, path.Base(src))
+	}
+
+	files, err := client.CopyFrom(context.Background(), &api.CopyRequest{Id: &api.TaskID{source[0]}, Path: src})
+	if err != nil {
+		log.Fatalln("Error copying files", err)
+	}
+
+	// file being written, nil before the first chunk
+	var file *os.File
+
+	for {
+		chunk, err := files.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalln("Error copying files", err)
+		}
+
+		// The first chunk of every file has its path in the task
+		if chunk.Path != "" {
+			if file != nil {
+				if err := file.Close(); err != nil {
+					log.Fatalln("Error writing file", err)
+				}
+			}
+
+			// Don't let files escape dest
+			if path.Clean(chunk.Path) != chunk.Path || !strings.HasPrefix(chunk.Path+"/", strings.TrimSuffix(src, "/")+"/") {
+				log.Fatalln("Unexpected file", chunk.Path)
+			}
+
+			rel := strings.TrimPrefix(chunk.Path, src)
+			file, err = createFile(filepath.Join(dest, filepath.FromSlash(rel)), chunk.Mode)
+			if err != nil {
+				log.Fatalln("Error creating file", err)
+			}
+		}
+
+		if file == nil {
+			log.Fatalln("Unexpected chunk without a file")
+		}
+
+		if _, err := file.Write(chunk.Data); err != nil {
+			log.Fatalln("Error writing file", err)
+		}
+	}
+
+	if file != nil {
+		if err := file.Close(); err != nil {
+			log.Fatalln("Error writing file", err)
+		}
+	}
+
+	return nil
+}
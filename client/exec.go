@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/console"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type execCommand struct {
+	Args struct {
+		Id      string   `description:"UUID of the running task to run the command in" required:"true"`
+		Command string   `description:"Command to run" required:"true"`
+		Args    []string `description:"Arguments to pass to Command"`
+	} `positional-args:"true"`
+
+	Tty bool `short:"t" long:"tty" description:"Run the command in a terminal (defaults to true if stdin is a terminal)"`
+
+	NoTty bool `short:"T" long:"no-tty" description:"Don't run the command in a terminal"`
+
+	Env []string `short:"e" long:"env" description:"Extra environment variable of the command as KEY=VALUE, or KEY to use the local value, can be repeated"`
+}
+
+func init() {
+	parser.AddCommand("exec", "Run a command inside a running task", "", &execCommand{})
+}
+
+// terminalSize returns the size of terminal
+func terminalSize(terminal console.Console) *api.TerminalSize {
+	size, err := terminal.Size()
+	if err != nil {
+		return nil
+	}
+
+	return &api.TerminalSize{Rows: uint32(size.Height), Cols: uint32(size.Width)}
+}
+
+// sendInput sends our stdin, and terminal resizes, to stream until stdin is closed
+func sendInput(stream api.TaskService_ExecClient, terminal console.Console) {
+	// Resizes are sent concurrently with stdin
+	var mutex sync.Mutex
+	send := func(req *api.ExecRequest) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return stream.Send(req)
+	}
+
+	if terminal != nil {
+		resizes := make(chan os.Signal, 1)
+		signal.Notify(resizes, syscall.SIGWINCH)
+
+		go func() {
+			for range resizes {
+				send(&api.ExecRequest{Msg: &api.ExecRequest_Resize{terminalSize(terminal)}})
+			}
+		}()
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if err := send(&api.ExecRequest{Msg: &api.ExecRequest_Stdin{append([]byte(nil), buf[:n]...)}}); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			send(&api.ExecRequest{Msg: &api.ExecRequest_CloseStdin{true}})
+			return
+		}
+	}
+}
+
+func (s *execCommand) Execute(args []string) error {
+	client := getClient()
+
+	start := &api.ExecStart{
+		Id:      &api.TaskID{s.Args.Id},
+		Command: s.Args.Command,
+		Args:    s.Args.Args,
+	}
+
+	for _, v := range s.Env {
+		start.Env = append(start.Env, envVar(v))
+	}
+
+	// Use a terminal if we're in one, unless asked not to
+	var terminal console.Console
+	if current, err := console.ConsoleFromFile(os.Stdin); err == nil && !s.NoTty {
+		terminal = current
+	}
+	if s.Tty && terminal == nil {
+		log.Fatalln("Can't run command in a terminal, stdin isn't a terminal")
+	}
+
+	if terminal != nil {
+		start.Tty = true
+		start.Size = terminalSize(terminal)
+	}
+
+	stream, err := client.Exec(context.Background())
+	if err != nil {
+		log.Fatalln("Error running command", err)
+	}
+
+	if err := stream.Send(&api.ExecRequest{Msg: &api.ExecRequest_Start{start}}); err != nil {
+		log.Fatalln("Error running command", err)
+	}
+
+	if terminal != nil {
+		if err := terminal.SetRaw(); err != nil {
+			log.Fatalln("Error setting terminal to raw mode", err)
+		}
+	}
+
+	// exit restores the terminal before exiting
+	exit := func(code int) {
+		if terminal != nil {
+			terminal.Reset()
+		}
+		os.Exit(code)
+	}
+
+	go sendInput(stream, terminal)
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			exit(exitFailed)
+		}
+		if err != nil {
+			if terminal != nil {
+				terminal.Reset()
+			}
+			log.Fatalln("Error running command", err)
+		}
+
+		switch msg := resp.Msg.(type) {
+		case *api.ExecResponse_Stdout:
+			os.Stdout.Write(msg.Stdout)
+		case *api.ExecResponse_Stderr:
+			os.Stderr.Write(msg.Stderr)
+		case *api.ExecResponse_ExitCode:
+			exit(int(msg.ExitCode))
+		}
+	}
+}
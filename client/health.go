@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type healthCommand struct{}
+
+func init() {
+	parser.AddCommand("health", "Get the health of a node", "", &healthCommand{})
+}
+
+func (s *healthCommand) Execute(args []string) error {
+	client := getClient()
+
+	health, err := client.Health(context.Background(), &api.Empty{})
+	if err != nil {
+		log.Fatalln("Error checking health", err)
+	}
+
+	since := time.Unix(health.Since, 0)
+
+	if health.Stealing {
+		log.Println("Node", health.NodeId.Uuid, "is running tasks since", since)
+	} else {
+		log.Println("Node", health.NodeId.Uuid, "is not running tasks since", since, "error:", health.Error)
+	}
+
+	log.Println("Stolen tasks:", health.Steals, "conflicts:", health.StealConflicts)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// imageChunkSize is the size of the chunks images are uploaded in
+const imageChunkSize = 64 * 1024
+
+type imageCommand struct{}
+
+type imageImportCommand struct {
+	Args struct {
+		File string `description:"OCI image layout tarball to import" required:"true"`
+	} `positional-args:"true"`
+
+	Name string `short:"n" long:"name" description:"Name to give the image, if the archive only contains one (defaults to its ref name annotation)"`
+}
+
+type imageListCommand struct{}
+
+func init() {
+	image, err := parser.AddCommand("image", "Manage the images of a node", "", &imageCommand{})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	image.AddCommand("import", "Import an OCI image layout tarball into the node", "", &imageImportCommand{})
+	image.AddCommand("list", "List the images of the node", "", &imageListCommand{})
+}
+
+// printImages prints a table of images to stdout
+func printImages(images *api.ImageList) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tDIGEST\tLAYERS")
+
+	for _, img := range images.Images {
+		fmt.Fprintf(table, "%s\t%s\t%d\n", img.Name, strings.TrimPrefix(img.Digest, "sha256:")[:12], len(img.Layers))
+	}
+
+	return table.Flush()
+}
+
+func (s *imageImportCommand) Execute(args []string) error {
+	client := getClient()
+
+	file, err := os.Open(s.Args.File)
+	if err != nil {
+		log.Fatalln("Error opening image", err)
+	}
+	defer file.Close()
+
+	stream, err := client.ImportImage(context.Background())
+	if err != nil {
+		log.Fatalln("Error importing image", err)
+	}
+
+	// Only the first chunk needs the name
+	chunk := &api.ImageChunk{Name: s.Name}
+	buf := make([]byte, imageChunkSize)
+
+	for {
+		n, err := file.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalln("Error reading image", err)
+		}
+
+		chunk.Data = buf[:n]
+		if err := stream.Send(chunk); err != nil {
+			break
+		}
+		chunk = &api.ImageChunk{}
+	}
+
+	// Errors sending are reported by CloseAndRecv
+	images, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Fatalln("Error importing image", err)
+	}
+
+	return printImages(images)
+}
+
+func (s *imageListCommand) Execute(args []string) error {
+	client := getClient()
+
+	images, err := client.ListImages(context.Background(), &api.Empty{})
+	if err != nil {
+		log.Fatalln("Error listing images", err)
+	}
+
+	return printImages(images)
+}
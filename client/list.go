@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type listCommand struct {
+	Status []string `short:"s" long:"status" choice:"queued" choice:"running" choice:"complete" choice:"canceled" choice:"failed" choice:"timed_out" description:"Only list tasks with this status, can be repeated"`
+
+	Node string `long:"node-uuid" description:"Only list tasks running, completed or timed out on the node with this UUID"`
+
+	Since time.Duration `long:"since" description:"Only list tasks done in the last duration (eg 24h)"`
+
+	PageSize int32 `long:"page-size" default:"100" description:"Number of tasks to retrieve at a time"`
+}
+
+func init() {
+	parser.AddCommand("list", "List tasks", "", &listCommand{})
+}
+
+// request builds the ListRequest from the parsed flags
+func (s *listCommand) request() *api.ListRequest {
+	req := &api.ListRequest{NodeUuid: s.Node, PageSize: s.PageSize}
+
+	for _, status := range s.Status {
+		req.Status = append(req.Status, api.ListRequest_Status(api.ListRequest_Status_value[strings.ToUpper(status)]))
+	}
+
+	if s.Since != 0 {
+		req.Since = time.Now().Add(-s.Since).Unix()
+	}
+
+	return req
+}
+
+// statusColumns returns the status, node, exit code and done time columns of a TaskStatus
+func statusColumns(status *api.TaskStatus) (string, string, string, string) {
+	switch status.Status.(type) {
+	case *api.TaskStatus_Queued_:
+		return "queued", "", "", ""
+	case *api.TaskStatus_Running_:
+		return "running", status.GetRunning().NodeId.Uuid, "", ""
+	case *api.TaskStatus_Complete_:
+		complete := status.GetComplete()
+		return "complete", complete.NodeId.Uuid, fmt.Sprint(complete.ExitCode), time.Unix(complete.Epoch, 0).Format(time.RFC3339)
+	case *api.TaskStatus_Canceled_:
+		return "canceled", "", "", time.Unix(status.GetCanceled().Epoch, 0).Format(time.RFC3339)
+	case *api.TaskStatus_Failed_:
+		return "failed", "", "", time.Unix(status.GetFailed().Epoch, 0).Format(time.RFC3339)
+	case *api.TaskStatus_TimedOut_:
+		timedOut := status.GetTimedOut()
+		return "timed_out", timedOut.NodeId.Uuid, "", time.Unix(timedOut.Epoch, 0).Format(time.RFC3339)
+	default:
+		return "unknown", "", "", ""
+	}
+}
+
+func (s *listCommand) Execute(args []string) error {
+	client := getClient()
+
+	req := s.request()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSTATUS\tNODE\tEXIT\tDONE\tRETRIES\tCOMMAND")
+
+	for {
+		resp, err := client.List(context.Background(), req)
+		if err != nil {
+			log.Fatalln("Error listing tasks", err)
+		}
+
+		for _, task := range resp.Tasks {
+			status, node, exitCode, done := statusColumns(task.Status)
+			command := strings.Join(append([]string{task.Request.Command}, task.Request.Args...), " ")
+
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", task.Id.Uuid, status, node, exitCode, done, len(task.Attempts), command)
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+
+	return table.Flush()
+}
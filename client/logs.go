@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
+	"os"
+	"time"
 
 	"github.com/arthurfabre/scheduler/api"
 )
@@ -12,22 +15,75 @@ type logsCommand struct {
 	Args struct {
 		Id string `description:"UUID of the task to display the logs of" required:"true"`
 	} `positional-args:"true"`
+
+	Stream string `long:"stream" default:"all" choice:"all" choice:"stdout" choice:"stderr" description:"Only display the output the task wrote to this stream"`
+
+	Timestamps bool `short:"t" long:"timestamps" description:"Prefix every line with the time it was written at"`
+
+	Tail uint32 `short:"n" long:"tail" description:"Only display the last N lines (defaults to all of them)"`
+
+	Since time.Duration `long:"since" description:"Only display the lines written in this long before now (eg 5m)"`
+
+	SinceOffset uint64 `long:"since-offset" description:"Only display the lines from this offset in the log"`
+
+	Follow bool `short:"f" long:"follow" description:"Keep displaying lines as they're written, while the task is running"`
 }
 
 func init() {
 	parser.AddCommand("logs", "Display the output of a task", "", &logsCommand{})
 }
 
+// printEntry prints a log entry to the stream it was written to, prefixed by its timestamp if timestamps is true
+func printEntry(entry *api.LogEntry, timestamps bool) {
+	out := os.Stdout
+	if entry.Stream == api.LogEntry_STDERR {
+		out = os.Stderr
+	}
+
+	// Lines are written as is, they might not be valid UTF-8
+	if timestamps {
+		fmt.Fprintf(out, "%s %s\n", time.Unix(0, entry.TimeNanos).Format(time.RFC3339Nano), entry.Line)
+	} else {
+		out.Write(append(entry.Line, '\n'))
+	}
+}
+
+// matchesStream returns true if entry was written to stream, one of the stream flag choices
+func matchesStream(entry *api.LogEntry, stream string) bool {
+	switch stream {
+	case "stdout":
+		return entry.Stream == api.LogEntry_STDOUT
+	case "stderr":
+		return entry.Stream == api.LogEntry_STDERR
+	default:
+		return true
+	}
+}
+
 func (s *logsCommand) Execute(args []string) error {
 	client := getClient()
 
-	logStream, err := client.Logs(context.Background(), &api.TaskID{s.Args.Id})
+	if s.Since < 0 {
+		log.Fatalln("Invalid since", s.Since)
+	}
+
+	req := &api.LogsRequest{
+		Id:          &api.TaskID{s.Args.Id},
+		TailLines:   s.Tail,
+		SinceOffset: s.SinceOffset,
+		Follow:      s.Follow,
+	}
+	if s.Since != 0 {
+		req.SinceTimeNanos = time.Now().Add(-s.Since).UnixNano()
+	}
+
+	logStream, err := client.Logs(context.Background(), req)
 	if err != nil {
 		log.Fatalln("Error getting logs", err)
 	}
 
 	for {
-		logEntry, err := logStream.Recv()
+		logs, err := logStream.Recv()
 		if err == io.EOF {
 			break
 		}
@@ -35,8 +91,10 @@ func (s *logsCommand) Execute(args []string) error {
 			log.Fatalln("Error retrieving log", err)
 		}
 
-		for _, line := range logEntry.Line {
-			log.Println(line)
+		for _, entry := range logs.Entries {
+			if matchesStream(entry, s.Stream) {
+				printEntry(entry, s.Timestamps)
+			}
 		}
 	}
 
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
 
 	"github.com/arthurfabre/scheduler/api"
+	"github.com/arthurfabre/scheduler/files"
 )
 
 type submitCommand struct {
@@ -13,22 +24,272 @@ type submitCommand struct {
 		Args    []string `description:"Arguments to pass to Command"`
 	} `positional-args:"true"`
 
-	// TODO - RAM, CPU...
+	Env []string `short:"e" long:"env" description:"Environment variable of the task as KEY=VALUE, or KEY to use the local value, can be repeated"`
+
+	EnvFile []string `long:"env-file" description:"File of KEY=VALUE environment variables of the task, one per line, can be repeated"`
+
+	WorkingDir string `short:"w" long:"workdir" description:"Absolute path of the directory the task is run in"`
+
+	User string `short:"u" long:"user" description:"User the task is run as, as user, uid, user:group or uid:gid (default root)"`
+
+	Image string `short:"i" long:"image" description:"Image to run the task in, only nodes that have it run the task (defaults to the rootfs of nodes)"`
+
+	KeepLayer bool `long:"keep-layer" description:"Keep the changes the task made to its rootfs once it's done, for inspection and cp"`
+
+	Inputs []string `long:"input" description:"Local file or directory to place in the rootfs of the task before it runs as LOCAL:PATH, PATH being absolute, can be repeated"`
+
+	CpuShares uint64 `long:"cpu-shares" description:"Relative CPU weight of the task"`
+
+	Cpus float64 `long:"cpus" description:"Maximum number of CPUs the task can use (eg 0.5)"`
+
+	Memory string `short:"m" long:"memory" description:"Maximum memory the task can use (eg 512m)"`
+
+	Pids uint64 `long:"pids" description:"Maximum number of processes the task can have"`
+
+	MaxAttempts uint32 `long:"max-attempts" description:"Maximum number of attempts at running the task (default 3)"`
+
+	RetryBackoff time.Duration `long:"retry-backoff" description:"Time to wait before the first retry, doubled for every subsequent retry (eg 10s)"`
+
+	RetryMaxBackoff time.Duration `long:"retry-max-backoff" description:"Maximum time to wait before a retry"`
+
+	RetryExitCodes []int32 `long:"retry-exit-code" description:"Exit code of the task to retry on, can be repeated"`
+
+	Timeout time.Duration `long:"timeout" description:"Kill the task if it runs for longer than this (eg 1h)"`
+
+	StopSignal string `long:"stop-signal" description:"Signal sent to the task when it is canceled (default SIGTERM)"`
+
+	StopGrace time.Duration `long:"stop-grace" description:"Time the task has to exit after its stop signal before being killed (default 10s)"`
+
+	Wait bool `long:"wait" description:"Wait for the task to finish, and exit with its exit code (125 if it failed, 130 if it was canceled, 124 if it timed out)"`
+
+	Follow bool `short:"f" long:"follow" description:"Print the logs of the task as they arrive, implies --wait"`
 }
 
 func init() {
 	parser.AddCommand("run", "Queue a task to be run", "", &submitCommand{})
 }
 
+// resources builds the Resources of a TaskRequest from the parsed flags
+func (s *submitCommand) resources() *api.Resources {
+	if s.Cpus < 0 {
+		log.Fatalln("Invalid CPU limit", s.Cpus)
+	}
+
+	res := &api.Resources{
+		CpuShares: s.CpuShares,
+		CpuMillis: uint64(s.Cpus * 1000),
+		Pids:      s.Pids,
+	}
+
+	if s.Memory != "" {
+		memory, err := units.RAMInBytes(s.Memory)
+		if err != nil || memory < 0 {
+			log.Fatalln("Invalid memory limit", s.Memory)
+		}
+		res.MemoryBytes = uint64(memory)
+	}
+
+	return res
+}
+
+// env builds the environment of a TaskRequest from the parsed flags. Variables given with -e override the env files.
+func (s *submitCommand) env() []string {
+	var env []string
+
+	for _, file := range s.EnvFile {
+		vars, err := readEnvFile(file)
+		if err != nil {
+			log.Fatalln("Error reading env file", err)
+		}
+		env = append(env, vars...)
+	}
+
+	for _, v := range s.Env {
+		env = append(env, envVar(v))
+	}
+
+	return env
+}
+
+// envVar converts a KEY=VALUE variable, or a KEY to look up in our environment, to KEY=VALUE
+func envVar(v string) string {
+	if strings.Contains(v, "=") {
+		return v
+	}
+
+	return v + "=" + os.Getenv(v)
+}
+
+// readEnvFile reads the KEY=VALUE variables of an env file. Blank lines and lines starting with # are ignored.
+func readEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var env []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		env = append(env, envVar(line))
+	}
+
+	return env, scanner.Err()
+}
+
+// timeoutSeconds converts the timeout flag to whole seconds, rounding up so short timeouts aren't disabled
+func (s *submitCommand) timeoutSeconds() uint32 {
+	if s.Timeout < 0 {
+		log.Fatalln("Invalid timeout", s.Timeout)
+	}
+
+	return uint32((s.Timeout + time.Second - 1) / time.Second)
+}
+
+// stopGraceSeconds converts the stop grace flag to whole seconds, rounding up so short grace periods aren't defaulted
+func (s *submitCommand) stopGraceSeconds() uint32 {
+	if s.StopGrace < 0 {
+		log.Fatalln("Invalid stop grace period", s.StopGrace)
+	}
+
+	return uint32((s.StopGrace + time.Second - 1) / time.Second)
+}
+
+// retryPolicy builds the RetryPolicy of a TaskRequest from the parsed flags.
+// Backoffs are rounded up to whole seconds, so short backoffs aren't disabled.
+func (s *submitCommand) retryPolicy() *api.RetryPolicy {
+	if s.RetryBackoff < 0 || s.RetryMaxBackoff < 0 {
+		log.Fatalln("Invalid retry backoff")
+	}
+
+	return &api.RetryPolicy{
+		MaxAttempts:       s.MaxAttempts,
+		BackoffSeconds:    uint32((s.RetryBackoff + time.Second - 1) / time.Second),
+		MaxBackoffSeconds: uint32((s.RetryMaxBackoff + time.Second - 1) / time.Second),
+		RetryExitCodes:    s.RetryExitCodes,
+	}
+}
+
+// inputPath splits an input file given as LOCAL:PATH
+func inputPath(input string) (string, string, error) {
+	i := strings.LastIndex(input, ":")
+	if i == -1 {
+		return "", "", fmt.Errorf("input %s isn't LOCAL:PATH", input)
+	}
+
+	local, remote := input[:i], input[i+1:]
+	if !path.IsAbs(remote) {
+		return "", "", fmt.Errorf("input %s path must be absolute", input)
+	}
+
+	return local, remote, nil
+}
+
+// sendFiles sends the regular files under local, a file or directory, as FileChunks placed under remote
+func sendFiles(local string, remote string, send func(*api.FileChunk) error) error {
+	local, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(local, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(local, file)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return files.Send(f, path.Join(remote, filepath.ToSlash(rel)), info.Mode(), send)
+	})
+}
+
+// submitFiles submits req with input files given as LOCAL:PATH
+func submitFiles(client api.TaskServiceClient, req *api.TaskRequest, inputs []string) (*api.TaskID, error) {
+	stream, err := client.SubmitFiles(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	send := func(chunk *api.FileChunk) error {
+		return stream.Send(&api.SubmitRequest{Msg: &api.SubmitRequest_Input{chunk}})
+	}
+
+	// Errors sending are reported by CloseAndRecv
+	if err := stream.Send(&api.SubmitRequest{Msg: &api.SubmitRequest_Request{req}}); err != nil {
+		return stream.CloseAndRecv()
+	}
+
+	for _, input := range inputs {
+		local, remote, err := inputPath(input)
+		if err != nil {
+			log.Fatalln("Invalid input file", err)
+		}
+
+		err = sendFiles(local, remote, send)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalln("Error sending input file", err)
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
 func (s *submitCommand) Execute(args []string) error {
 	client := getClient()
 
-	id, err := client.Submit(context.Background(), &api.TaskRequest{s.Args.Command, s.Args.Args})
+	req := &api.TaskRequest{
+		Command:          s.Args.Command,
+		Args:             s.Args.Args,
+		Env:              s.env(),
+		WorkingDir:       s.WorkingDir,
+		User:             s.User,
+		KeepLayer:        s.KeepLayer,
+		Image:            s.Image,
+		Resources:        s.resources(),
+		Retry:            s.retryPolicy(),
+		TimeoutSeconds:   s.timeoutSeconds(),
+		StopSignal:       s.StopSignal,
+		StopGraceSeconds: s.stopGraceSeconds(),
+	}
+
+	var id *api.TaskID
+	var err error
+	if len(s.Inputs) == 0 {
+		id, err = client.Submit(context.Background(), req)
+	} else {
+		id, err = submitFiles(client, req, s.Inputs)
+	}
 	if err != nil {
 		log.Fatalln("Error queuing task", err)
 	}
 
 	log.Println("Task submitted as", id.Uuid)
 
+	if s.Wait || s.Follow {
+		os.Exit(waitTask(client, id, s.Follow))
+	}
+
 	return nil
 }
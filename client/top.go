@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type topCommand struct {
+	Args struct {
+		Id string `description:"UUID of the running task to show the resource usage of" required:"true"`
+	} `positional-args:"true"`
+
+	Interval time.Duration `long:"interval" default:"1s" description:"Interval between updates"`
+}
+
+func init() {
+	parser.AddCommand("top", "Show the live resource usage of a running task", "", &topCommand{})
+}
+
+// cpuPercent returns the CPU usage between two stats, as a percentage of one CPU
+func cpuPercent(prev *api.TaskStats, cur *api.TaskStats) float64 {
+	if prev == nil || cur.Epoch <= prev.Epoch {
+		return 0
+	}
+
+	return float64(cur.CpuNanos-prev.CpuNanos) / float64(cur.Epoch-prev.Epoch) * 100
+}
+
+// limit formats a limit, 0 being unlimited
+func limit(value uint64, format func(uint64) string) string {
+	if value == 0 {
+		return "-"
+	}
+
+	return format(value)
+}
+
+func (s *topCommand) Execute(args []string) error {
+	client := getClient()
+
+	stats, err := client.Stats(context.Background(), &api.StatsRequest{Id: &api.TaskID{s.Args.Id}, IntervalMillis: uint32(s.Interval / time.Millisecond)})
+	if err != nil {
+		log.Fatalln("Error getting task stats", err)
+	}
+
+	bytes := func(b uint64) string {
+		return units.BytesSize(float64(b))
+	}
+	count := func(n uint64) string {
+		return fmt.Sprint(n)
+	}
+
+	var prev *api.TaskStats
+
+	for {
+		cur, err := stats.Recv()
+		if err == io.EOF {
+			log.Println("Task stopped running")
+			return nil
+		}
+		if err != nil {
+			log.Fatalln("Error getting task stats", err)
+		}
+
+		// Clear the screen, and redraw
+		fmt.Print("\033[H\033[2J")
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "CPU %\tCPU TIME\tMEM\tMEM PEAK\tMEM LIMIT\tPIDS\tPIDS LIMIT\tIO READ\tIO WRITE")
+		fmt.Fprintf(table, "%.2f\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			cpuPercent(prev, cur),
+			time.Duration(cur.CpuNanos).Round(time.Millisecond),
+			bytes(cur.MemoryBytes),
+			bytes(cur.MaxMemoryBytes),
+			limit(cur.MemoryLimitBytes, bytes),
+			cur.Pids,
+			limit(cur.PidsLimit, count),
+			bytes(cur.IoReadBytes),
+			bytes(cur.IoWriteBytes),
+		)
+		table.Flush()
+
+		prev = cur
+	}
+}
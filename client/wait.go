@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// Exit codes used when a task didn't complete
+const (
+	// exitFailed is used when the task failed due to an error
+	exitFailed = 125
+
+	// exitCanceled is used when the task was canceled
+	exitCanceled = 130
+
+	// exitTimedOut is used when the task was killed for running longer than its timeout
+	exitTimedOut = 124
+)
+
+// exitCode returns the exit code matching a terminal TaskStatus, and false if the status isn't terminal
+func exitCode(status *api.TaskStatus) (int, bool) {
+	switch status.Status.(type) {
+	case *api.TaskStatus_Complete_:
+		return int(status.GetComplete().ExitCode), true
+	case *api.TaskStatus_Canceled_:
+		return exitCanceled, true
+	case *api.TaskStatus_Failed_:
+		return exitFailed, true
+	case *api.TaskStatus_TimedOut_:
+		return exitTimedOut, true
+	default:
+		return 0, false
+	}
+}
+
+// printLogs prints the logs of a task, following them until it stops running if follow is true
+func printLogs(client api.TaskServiceClient, id *api.TaskID, follow bool) error {
+	logStream, err := client.Logs(context.Background(), &api.LogsRequest{Id: id, Follow: follow})
+	if err != nil {
+		return err
+	}
+
+	for {
+		logs, err := logStream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range logs.Entries {
+			printEntry(entry, false)
+		}
+	}
+}
+
+// waitTask blocks until a task reaches a terminal status, returning the exit code matching it.
+// If follow is true, the logs of the task are printed as they arrive.
+func waitTask(client api.TaskServiceClient, id *api.TaskID, follow bool) int {
+	transitions, err := client.Watch(context.Background(), &api.WatchRequest{Ids: []*api.TaskID{id}})
+	if err != nil {
+		log.Fatalln("Error watching task", err)
+	}
+
+	// following is closed once the logs of the current attempt at running the task have been printed
+	var following chan struct{}
+
+	for {
+		transition, err := transitions.Recv()
+		if err != nil {
+			log.Fatalln("Error watching task", err)
+		}
+
+		status := transition.Status
+
+		// The log stream of every attempt ends once the task stops running, so the previous one is done or about to be
+		if follow && status.GetRunning() != nil {
+			if following != nil {
+				<-following
+			}
+
+			following = make(chan struct{})
+			go func(following chan struct{}) {
+				defer close(following)
+
+				if err := printLogs(client, id, true); err != nil {
+					log.Println("Error following logs", err)
+				}
+			}(following)
+		}
+
+		code, done := exitCode(status)
+		if !done {
+			continue
+		}
+
+		if following != nil {
+			<-following
+		} else if follow && (status.GetComplete() != nil || status.GetTimedOut() != nil) {
+			// The task finished before we saw it running
+			if err := printLogs(client, id, false); err != nil {
+				log.Println("Error retrieving logs", err)
+			}
+		}
+
+		return code
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+type watchCommand struct {
+	Args struct {
+		Ids []string `description:"UUIDs of the tasks to watch (defaults to all tasks)"`
+	} `positional-args:"true"`
+
+	Status []string `short:"s" long:"status" choice:"queued" choice:"running" choice:"complete" choice:"canceled" choice:"failed" choice:"timed_out" description:"Only watch transitions to this status, can be repeated"`
+
+	Node string `long:"node-uuid" description:"Only watch tasks running, completed or timed out on the node with this UUID"`
+
+	Revision int64 `short:"r" long:"revision" description:"Only watch transitions made after this revision"`
+}
+
+func init() {
+	parser.AddCommand("watch", "Watch the status transitions of tasks", "", &watchCommand{})
+}
+
+// request builds the WatchRequest from the parsed flags
+func (s *watchCommand) request() *api.WatchRequest {
+	req := &api.WatchRequest{NodeUuid: s.Node, Revision: s.Revision}
+
+	for _, id := range s.Args.Ids {
+		req.Ids = append(req.Ids, &api.TaskID{id})
+	}
+
+	for _, status := range s.Status {
+		req.Status = append(req.Status, api.ListRequest_Status(api.ListRequest_Status_value[strings.ToUpper(status)]))
+	}
+
+	return req
+}
+
+func (s *watchCommand) Execute(args []string) error {
+	client := getClient()
+
+	transitions, err := client.Watch(context.Background(), s.request())
+	if err != nil {
+		log.Fatalln("Error watching tasks", err)
+	}
+
+	for {
+		transition, err := transitions.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalln("Error watching tasks", err)
+		}
+
+		status, node, exitCode, _ := statusColumns(transition.Status)
+		fmt.Println(transition.Revision, transition.Id.Uuid, status, node, exitCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+// Package files sends files as streams of FileChunks
+package files
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// ChunkSize is the size of the chunks files are sent in
+const ChunkSize = 64 * 1024
+
+// Send sends the content of r as the FileChunks of the file name, with mode
+func Send(r io.Reader, name string, mode os.FileMode, send func(*api.FileChunk) error) error {
+	// Only the first chunk has the path and mode
+	chunk := &api.FileChunk{Path: name, Mode: uint32(mode.Perm())}
+	buf := make([]byte, ChunkSize)
+
+	for {
+		n, err := r.Read(buf)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading file: %s", err)
+		}
+
+		// Empty files are sent as a single chunk without data
+		if n > 0 || chunk.Path != "" {
+			chunk.Data = buf[:n]
+			if err := send(chunk); err != nil {
+				return err
+			}
+			chunk = &api.FileChunk{}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/arthurfabre/scheduler/api"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/hpcloud/tail"
 	"google.golang.org/grpc"
 )
@@ -16,6 +23,64 @@ import (
 type taskServiceServer struct {
 	client *clientv3.Client
 	id     *api.NodeID
+
+	// health of the Runner on this node
+	health *health
+
+	// counters of steal outcomes of the Runner on this node
+	counters *stealCounters
+
+	// images of this node
+	images *imageStore
+
+	// containers of the tasks running on this node
+	containers *containers
+}
+
+// Interval between the stats of a task, if the request doesn't say
+const defaultStatsInterval = time.Second
+
+// nodeClient connects to the API of node, for proxying requests. conn must be closed.
+func nodeClient(node *api.NodeID) (api.TaskServiceClient, *grpc.ClientConn, error) {
+	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", node.Ip, node.Port), grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return api.NewTaskServiceClient(conn), conn, nil
+}
+
+// imageChunkReader reads the data of a stream of ImageChunks
+type imageChunkReader struct {
+	stream api.TaskService_ImportImageServer
+
+	// buf is the data of the current chunk left to read
+	buf []byte
+}
+
+func (r *imageChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// imageList converts images of the store to an ImageList
+func imageList(images []*image) *api.ImageList {
+	list := &api.ImageList{}
+	for _, img := range images {
+		list.Images = append(list.Images, &api.Image{Name: img.Name, Digest: img.Digest, Layers: img.Layers})
+	}
+
+	return list
 }
 
 func (s *taskServiceServer) Submit(ctx context.Context, req *api.TaskRequest) (*api.TaskID, error) {
@@ -32,6 +97,166 @@ func (s *taskServiceServer) Submit(ctx context.Context, req *api.TaskRequest) (*
 	return task.Id, nil
 }
 
+func (s *taskServiceServer) SubmitFiles(stream api.TaskService_SubmitFilesServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	req := first.GetRequest()
+	if req == nil {
+		return fmt.Errorf("first SubmitRequest must be the task")
+	}
+
+	task, err := newTask(req)
+	if err != nil {
+		return err
+	}
+
+	// Input files are kept on this node until the task is deleted, the node running it fetches them.
+	// They're uploaded to a temporary directory first, so they aren't removed as orphans before the task is queued.
+	if err := os.MkdirAll(filepath.Dir(getInputs(task.Id)), 0700); err != nil {
+		return fmt.Errorf("error creating input directory: %s", err)
+	}
+
+	upload, err := ioutil.TempDir(filepath.Dir(getInputs(task.Id)), ".upload")
+	if err != nil {
+		return fmt.Errorf("error creating task input directory: %s", err)
+	}
+	defer os.RemoveAll(upload)
+
+	err = receiveFiles(&fileWriter{root: upload}, func() (*api.FileChunk, error) {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		input := msg.GetInput()
+		if input == nil {
+			return nil, fmt.Errorf("SubmitRequest after the first must be input files")
+		}
+
+		return input, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The inputs must be in place before the task can be stolen.
+	// Orphan removal skips recent input directories, so they're kept until the task is queued.
+	inputs := getInputs(task.Id)
+	if err := os.Rename(upload, inputs); err != nil {
+		return fmt.Errorf("error storing task input files: %s", err)
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(inputs, now, now); err != nil {
+		os.RemoveAll(inputs)
+		return fmt.Errorf("error storing task input files: %s", err)
+	}
+
+	task.InputNode = s.id
+
+	if err := task.queue(stream.Context(), s.client); err != nil {
+		os.RemoveAll(inputs)
+		return err
+	}
+
+	return stream.SendAndClose(task.Id)
+}
+
+func (s *taskServiceServer) Inputs(id *api.TaskID, stream api.TaskService_InputsServer) error {
+	task, err := getTask(stream.Context(), s.client, id)
+	if err != nil {
+		return err
+	}
+
+	if task.InputNode == nil || task.InputNode.Uuid != s.id.Uuid {
+		return fmt.Errorf("task %s input files aren't stored on this node", id.Uuid)
+	}
+
+	return sendFiles(getInputs(id), "/", stream.Send)
+}
+
+func (s *taskServiceServer) CopyFrom(req *api.CopyRequest, stream api.TaskService_CopyFromServer) error {
+	if !path.IsAbs(req.Path) {
+		return fmt.Errorf("CopyRequest field path must be an absolute path")
+	}
+
+	task, err := getTask(stream.Context(), s.client, req.Id)
+	if err != nil {
+		return err
+	}
+
+	id := task.Id
+
+	// Id of the node that ran the task
+	var nodeId *api.NodeID
+	// True if the task is done
+	var isDone bool
+
+	switch task.Status.Status.(type) {
+	case *api.TaskStatus_Queued_:
+		return fmt.Errorf("task %s is queued", id.Uuid)
+	case *api.TaskStatus_Running_:
+		nodeId = task.Status.GetRunning().NodeId
+		isDone = false
+	case *api.TaskStatus_Complete_:
+		nodeId = task.Status.GetComplete().NodeId
+		isDone = true
+	case *api.TaskStatus_Canceled_:
+		return fmt.Errorf("task %s is canceled", id.Uuid)
+	case *api.TaskStatus_Failed_:
+		return fmt.Errorf("task %s has failed", id.Uuid)
+	case *api.TaskStatus_TimedOut_:
+		nodeId = task.Status.GetTimedOut().NodeId
+		isDone = true
+	default:
+		return fmt.Errorf("task %s unknown status", id.Uuid)
+	}
+
+	// The layers of finished tasks are removed, unless they asked to keep them
+	if isDone && !task.Request.KeepLayer {
+		return fmt.Errorf("task %s didn't keep its layer", id.Uuid)
+	}
+
+	// We didn't run the task, proxy to the node that did
+	if nodeId.Uuid != s.id.Uuid {
+		client, conn, err := nodeClient(nodeId)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		files, err := client.CopyFrom(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		for {
+			chunk, err := files.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Running tasks have their rootfs mounted, finished ones only have the changes they made
+	dir := mergedDir
+	if isDone {
+		dir = upperDir
+	}
+
+	return sendFiles(filepath.Join(getLayer(id), dir), req.Path, stream.Send)
+}
+
 func (s *taskServiceServer) Status(ctx context.Context, id *api.TaskID) (*api.TaskStatus, error) {
 	task, err := getTask(ctx, s.client, id)
 	if err != nil {
@@ -41,7 +266,9 @@ func (s *taskServiceServer) Status(ctx context.Context, id *api.TaskID) (*api.Ta
 	return task.Status, nil
 }
 
-func (s *taskServiceServer) Cancel(ctx context.Context, id *api.TaskID) (*api.Empty, error) {
+func (s *taskServiceServer) Cancel(ctx context.Context, req *api.CancelRequest) (*api.Empty, error) {
+	id := req.Id
+
 	task, err := getTask(ctx, s.client, id)
 	if err != nil {
 		return nil, err
@@ -56,14 +283,25 @@ func (s *taskServiceServer) Cancel(ctx context.Context, id *api.TaskID) (*api.Em
 	case *api.TaskStatus_Complete_:
 		return nil, fmt.Errorf("task %s is already complete", id.Uuid)
 	case *api.TaskStatus_Canceled_:
-		return nil, fmt.Errorf("task %s is already canceled", id.Uuid)
+		// A canceled task might still be exiting, it can be killed straight away
+		if !req.Force || task.Status.GetCanceled().Force {
+			return nil, fmt.Errorf("task %s is already canceled", id.Uuid)
+		}
+
+		if err := task.forceCancel(ctx, s.client); err != nil {
+			return nil, err
+		}
+
+		return &api.Empty{}, nil
 	case *api.TaskStatus_Failed_:
 		return nil, fmt.Errorf("task %s has failed", id.Uuid)
+	case *api.TaskStatus_TimedOut_:
+		return nil, fmt.Errorf("task %s has timed out", id.Uuid)
 	default:
 		return nil, fmt.Errorf("task %s unknown status", id.Uuid)
 	}
 
-	err = task.cancel(ctx, s.client)
+	err = task.cancel(ctx, s.client, req.Force)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +309,9 @@ func (s *taskServiceServer) Cancel(ctx context.Context, id *api.TaskID) (*api.Em
 	return &api.Empty{}, nil
 }
 
-func (s *taskServiceServer) Logs(id *api.TaskID, stream api.TaskService_LogsServer) error {
+func (s *taskServiceServer) Logs(req *api.LogsRequest, stream api.TaskService_LogsServer) error {
+	id := req.Id
+
 	task, err := getTask(stream.Context(), s.client, id)
 	if err != nil {
 		return err
@@ -95,57 +335,332 @@ func (s *taskServiceServer) Logs(id *api.TaskID, stream api.TaskService_LogsServ
 		return fmt.Errorf("task %s is canceled", id.Uuid)
 	case *api.TaskStatus_Failed_:
 		return fmt.Errorf("task %s has failed", id.Uuid)
+	case *api.TaskStatus_TimedOut_:
+		nodeId = task.Status.GetTimedOut().NodeId
+		isDone = true
 	default:
 		return fmt.Errorf("task %s unknown status", id.Uuid)
 	}
 
 	// We're not running / handling the task, proxy to the node that is
 	if nodeId.Uuid != s.id.Uuid {
-		conn, err := grpc.Dial(fmt.Sprintf("%s:%d", nodeId.Ip, nodeId.Port), grpc.WithInsecure())
+		alive, err := isAlive(stream.Context(), s.client, nodeId)
 		if err != nil {
 			return err
 		}
-		defer conn.Close()
 
-		client := api.NewTaskServiceClient(conn)
+		// The logs of finished tasks are replicated, in case the node that ran them is gone or unreachable
+		if !alive && isDone {
+			return sendLogReplica(stream.Context(), s.client, req, task.Status, stream)
+		}
+
+		forwarded, err := proxyLogs(nodeId, req, stream)
+		if err != nil && !forwarded && isDone {
+			if replicaErr := sendLogReplica(stream.Context(), s.client, req, task.Status, stream); replicaErr != nil {
+				return err
+			}
+			return nil
+		}
+
+		return err
+	}
+
+	// Skip the entries before the ones requested, without reading them
+	start, err := logStart(getLog(id), req)
+	if err != nil {
+		return err
+	}
+
+	// tail -f the log file if the task is not done, and we're asked to
+	follow := req.Follow && !isDone
+
+	logFile, err := tail.TailFile(getLog(id), tail.Config{Follow: follow, Location: &tail.SeekInfo{Offset: start, Whence: io.SeekStart}})
+	if err != nil {
+		return err
+	}
+	defer logFile.Stop()
+
+	// Status of the task once it's done, sent at the end of the stream
+	status := make(chan *api.TaskStatus, 1)
+
+	if follow {
+		ctx, cancel := context.WithCancel(stream.Context())
+		defer cancel()
+
+		go func() {
+			// The log is complete once the task has stopped running, send what's left of it
+			status <- waitStopped(ctx, s.client, task)
+			logFile.StopAtEOF()
+		}()
+	} else if isDone {
+		status <- task.Status
+	} else {
+		status <- nil
+	}
+
+	for line := range logFile.Lines {
+		if line.Err != nil {
+			return line.Err
+		}
+
+		entry := parseLogEntry([]byte(line.Text))
+		if !matchesLogsRequest(entry, req) {
+			continue
+		}
+
+		err = stream.Send(&api.Log{Entries: []*api.LogEntry{entry}})
+		if err != nil {
+			return err
+		}
+	}
+
+	if final := <-status; final != nil {
+		return stream.Send(&api.Log{Status: final})
+	}
+
+	return nil
+}
+
+func (s *taskServiceServer) List(ctx context.Context, req *api.ListRequest) (*api.ListResponse, error) {
+	return listPage(ctx, s.client, req)
+}
+
+func (s *taskServiceServer) Watch(req *api.WatchRequest, stream api.TaskService_WatchServer) error {
+	ctx := stream.Context()
+
+	ids := make(map[string]bool)
+	for _, id := range req.Ids {
+		if err := checkTaskID(id); err != nil {
+			return err
+		}
+		ids[id.Uuid] = true
+	}
+
+	// send sends the status of task if it matches the filters
+	send := func(task *Task) error {
+		if len(ids) > 0 && !ids[task.Id.Uuid] {
+			return nil
+		}
+
+		if !matchesStatus(task.Status, req.Status) || !matchesNode(task, req.NodeUuid) {
+			return nil
+		}
 
-		logs, err := client.Logs(stream.Context(), id)
+		return stream.Send(&api.TaskTransition{Id: task.Id, Status: task.Status, Revision: task.modRevision})
+	}
+
+	rev := req.Revision
+	if rev == 0 {
+		// Only watch transitions made from now on
+		resp, err := s.client.Get(ctx, statusPrefix(), clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+		rev = resp.Header.Revision
+
+		// Send the current status of the tasks we're watching, as of the revision we watch from, so nothing is missed
+		for _, id := range req.Ids {
+			task, err := getTask(ctx, s.client, id, clientv3.WithRev(rev))
+			if err != nil {
+				return err
+			}
+
+			if err := send(task); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Every transition puts a new status key
+	for taskEvent := range watchTasks(ctx, s.client, statusPrefix(), rev, clientv3.WithPrefix(), clientv3.WithFilterDelete()) {
+		switch taskEvent.(type) {
+		case TaskUpdate:
+			task := taskEvent.(TaskUpdate).task
+			if err := send(task); err != nil {
+				return err
+			}
+
+			// Transitions are seen in order, the watch is resumed after the last one
+			if task.modRevision > rev {
+				rev = task.modRevision
+			}
+
+		case TaskError:
+			taskError := taskEvent.(TaskError)
+			if taskError.err == rpctypes.ErrCompacted {
+				return fmt.Errorf("revisions after %d have been compacted, tasks need to be listed again", rev)
+			}
+
+			log.Println("Error watching task transitions:", taskError.err)
+		}
+	}
+
+	return nil
+}
+
+func (s *taskServiceServer) Stats(req *api.StatsRequest, stream api.TaskService_StatsServer) error {
+	ctx := stream.Context()
+
+	task, err := getTask(ctx, s.client, req.Id)
+	if err != nil {
+		return err
+	}
+
+	running := task.Status.GetRunning()
+	if running == nil {
+		return fmt.Errorf("task %s isn't running", req.Id.Uuid)
+	}
+
+	// We're not running the task, proxy to the node that is
+	if running.NodeId.Uuid != s.id.Uuid {
+		client, conn, err := nodeClient(running.NodeId)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		stats, err := client.Stats(ctx, req)
 		if err != nil {
 			return err
 		}
 
 		for {
-			log, err := logs.Recv()
+			taskStats, err := stats.Recv()
 			if err == io.EOF {
-				break
+				return nil
 			}
 			if err != nil {
 				return err
 			}
 
-			err = stream.Send(log)
-			if err != nil {
+			if err := stream.Send(taskStats); err != nil {
 				return err
 			}
 		}
-		return nil
 	}
 
-	// tail -f the log file if the task is not done
-	// TODO - If the task finished in the meantime, we won't know
-	logFile, err := tail.TailFile(getLog(id), tail.Config{Follow: !isDone})
-	if err != nil {
-		return err
+	interval := time.Duration(req.IntervalMillis) * time.Millisecond
+	if interval == 0 {
+		interval = defaultStatsInterval
 	}
 
-	for line := range logFile.Lines {
-		err = stream.Send(&api.Log{[]string{line.Text}})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for sent := false; ; sent = true {
+		container, ok := s.containers.get(req.Id)
+		if !ok {
+			// The task has stopped running
+			if sent {
+				return nil
+			}
+			return fmt.Errorf("task %s isn't running on this node", req.Id.Uuid)
+		}
+
+		taskStats, err := taskStats(container)
 		if err != nil {
+			// The task might have stopped running in the meantime
+			if _, ok := s.containers.get(req.Id); !ok && sent {
+				return nil
+			}
+			return fmt.Errorf("error reading task stats: %s", err)
+		}
+
+		if err := stream.Send(taskStats); err != nil {
 			return err
 		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
 	}
+}
 
-	return nil
+func (s *taskServiceServer) Exec(stream api.TaskService_ExecServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	start := req.GetStart()
+	if start == nil {
+		return fmt.Errorf("first ExecRequest must start the process")
+	}
+	if start.Command == "" {
+		return fmt.Errorf("ExecStart missing required field command")
+	}
+	if err := checkEnv(start.Env); err != nil {
+		return err
+	}
+
+	task, err := getTask(stream.Context(), s.client, start.Id)
+	if err != nil {
+		return err
+	}
+
+	running := task.Status.GetRunning()
+	if running == nil {
+		return fmt.Errorf("task %s isn't running", start.Id.Uuid)
+	}
+
+	// We're not running the task, proxy to the node that is
+	if running.NodeId.Uuid != s.id.Uuid {
+		return proxyExec(stream, running.NodeId, req)
+	}
+
+	container, ok := s.containers.get(start.Id)
+	if !ok {
+		return fmt.Errorf("task %s isn't running on this node", start.Id.Uuid)
+	}
+
+	return execTask(stream, container, task, start)
+}
+
+func (s *taskServiceServer) Health(ctx context.Context, _ *api.Empty) (*api.NodeHealth, error) {
+	since, err := s.health.get()
+
+	steals, conflicts := s.counters.get()
+
+	health := &api.NodeHealth{
+		NodeId:         s.id,
+		Stealing:       err == nil,
+		Since:          since.Unix(),
+		Steals:         steals,
+		StealConflicts: conflicts,
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	return health, nil
+}
+
+func (s *taskServiceServer) ImportImage(stream api.TaskService_ImportImageServer) error {
+	// The first chunk names the image
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	images, err := s.images.importArchive(&imageChunkReader{stream: stream, buf: first.Data}, first.Name)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Imported", len(images), "images")
+
+	return stream.SendAndClose(imageList(images))
+}
+
+func (s *taskServiceServer) ListImages(ctx context.Context, _ *api.Empty) (*api.ImageList, error) {
+	images, err := s.images.list()
+	if err != nil {
+		return nil, err
+	}
+
+	return imageList(images), nil
 }
 
 // Run runs the gRPC server for the API. Blocking.
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// capacity tracks the resources of this node that can be allocated to tasks, and how much of them running tasks have reserved.
+type capacity struct {
+	sync.Mutex
+
+	// cpuMillis is the total CPU time that can be allocated, in thousandths of a CPU
+	cpuMillis uint64
+
+	// memoryBytes is the total memory that can be allocated, in bytes
+	memoryBytes uint64
+
+	// reservedCpuMillis is the CPU time reserved by running tasks
+	reservedCpuMillis uint64
+
+	// reservedMemoryBytes is the memory reserved by running tasks
+	reservedMemoryBytes uint64
+
+	// tasks is the number of running tasks
+	tasks uint64
+
+	// maxTasks is the maximum number of tasks that can run at once, 0 for unlimited
+	maxTasks uint64
+
+	// deferred is true if a task didn't fit since capacity was last freed
+	deferred bool
+
+	// freed is signaled when capacity is freed after a task was deferred
+	freed chan struct{}
+}
+
+// hostCapacity returns the CPU (in thousandths of a CPU) and memory (in bytes) of the host
+func hostCapacity() (uint64, uint64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, 0, fmt.Errorf("error getting host memory: %s", err)
+	}
+
+	return uint64(runtime.NumCPU()) * 1000, uint64(info.Totalram) * uint64(info.Unit), nil
+}
+
+// newCapacity creates a capacity of cpuMillis and memoryBytes, running at most maxTasks at once.
+// cpuMillis and memoryBytes can be 0, in which case the capacity of the host is used.
+// maxTasks can be 0, in which case the number of tasks is unlimited.
+func newCapacity(cpuMillis uint64, memoryBytes uint64, maxTasks uint64) (*capacity, error) {
+	hostCpuMillis, hostMemoryBytes, err := hostCapacity()
+	if err != nil {
+		return nil, err
+	}
+
+	if cpuMillis == 0 {
+		cpuMillis = hostCpuMillis
+	}
+
+	if memoryBytes == 0 {
+		memoryBytes = hostMemoryBytes
+	}
+
+	return &capacity{cpuMillis: cpuMillis, memoryBytes: memoryBytes, maxTasks: maxTasks, freed: make(chan struct{}, 1)}, nil
+}
+
+// requirements returns the CPU and memory a task requires. res may be nil.
+func requirements(res *api.Resources) (uint64, uint64) {
+	if res == nil {
+		return 0, 0
+	}
+
+	return res.CpuMillis, res.MemoryBytes
+}
+
+// fits returns true if res could ever fit in this capacity, ie if no tasks were running.
+func (c *capacity) fits(res *api.Resources) bool {
+	cpuMillis, memoryBytes := requirements(res)
+
+	return cpuMillis <= c.cpuMillis && memoryBytes <= c.memoryBytes
+}
+
+// isFull returns true if no more tasks can be run until one finishes.
+func (c *capacity) isFull() bool {
+	return c.maxTasks > 0 && c.tasks >= c.maxTasks
+}
+
+// hasSlot returns true if another task can be run, regardless of its resources.
+// If not, freed will be signaled when a task finishes.
+func (c *capacity) hasSlot() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.isFull() {
+		c.deferred = true
+		return false
+	}
+
+	return true
+}
+
+// reserve reserves a task slot and the resources required by res, returning false if they don't fit.
+func (c *capacity) reserve(res *api.Resources) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	cpuMillis, memoryBytes := requirements(res)
+
+	if c.isFull() || c.reservedCpuMillis+cpuMillis > c.cpuMillis || c.reservedMemoryBytes+memoryBytes > c.memoryBytes {
+		c.deferred = true
+		return false
+	}
+
+	c.reservedCpuMillis += cpuMillis
+	c.reservedMemoryBytes += memoryBytes
+	c.tasks++
+
+	return true
+}
+
+// release frees the task slot and resources previously reserved by res.
+// If a task was deferred since capacity was last freed, freed is signaled.
+func (c *capacity) release(res *api.Resources) {
+	c.Lock()
+	defer c.Unlock()
+
+	cpuMillis, memoryBytes := requirements(res)
+
+	c.reservedCpuMillis -= cpuMillis
+	c.reservedMemoryBytes -= memoryBytes
+	c.tasks--
+
+	if !c.deferred {
+		return
+	}
+
+	c.deferred = false
+
+	// Don't block if a signal is already pending
+	select {
+	case c.freed <- struct{}{}:
+	default:
+	}
+}
+
+// taskLoad returns the fraction of task slots used, or the number of running tasks per allocatable CPU if unlimited
+func (c *capacity) taskLoad() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.maxTasks > 0 {
+		return float64(c.tasks) / float64(c.maxTasks)
+	}
+
+	return float64(c.tasks) * 1000 / float64(c.cpuMillis)
+}
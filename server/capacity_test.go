@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// TestCapacity tests reserving and releasing capacity
+func TestCapacity(t *testing.T) {
+	c := &capacity{cpuMillis: 1000, memoryBytes: 1024, freed: make(chan struct{}, 1)}
+
+	half := &api.Resources{CpuMillis: 500, MemoryBytes: 512}
+
+	if !c.reserve(half) || !c.reserve(half) {
+		t.Fatal("expected two halves to fit")
+	}
+
+	if c.reserve(half) {
+		t.Fatal("expected third half not to fit")
+	}
+
+	// Tasks without requirements always fit
+	if !c.reserve(nil) {
+		t.Fatal("expected task without requirements to fit")
+	}
+
+	c.release(half)
+
+	select {
+	case <-c.freed:
+	default:
+		t.Fatal("expected freed to be signaled after deferring a task")
+	}
+
+	if !c.reserve(half) {
+		t.Fatal("expected half to fit after release")
+	}
+
+	if c.fits(&api.Resources{CpuMillis: 2000}) {
+		t.Error("expected task larger than capacity to never fit")
+	}
+}
+
+// TestMaxTasks tests task slots are limited
+func TestMaxTasks(t *testing.T) {
+	c := &capacity{cpuMillis: 1000, memoryBytes: 1024, maxTasks: 1, freed: make(chan struct{}, 1)}
+
+	if !c.hasSlot() || !c.reserve(nil) {
+		t.Fatal("expected first task to fit")
+	}
+
+	if c.hasSlot() || c.reserve(nil) {
+		t.Fatal("expected second task not to fit")
+	}
+
+	c.release(nil)
+
+	select {
+	case <-c.freed:
+	default:
+		t.Fatal("expected freed to be signaled after a slot frees")
+	}
+
+	if !c.hasSlot() {
+		t.Error("expected a slot after release")
+	}
+}
@@ -88,6 +88,10 @@ func RunEtcd(c etcdConfig) error {
 	// We only use v3
 	cfg.EnableV2 = false
 
+	// Old revisions of log replicas and tasks count towards the backend quota (2GiB by default) until they're compacted
+	cfg.AutoCompactionMode = "periodic"
+	cfg.AutoCompactionRetention = "1h"
+
 	e, err := embed.StartEtcd(cfg)
 	if err != nil {
 		return err
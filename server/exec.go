@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/utils"
+	"golang.org/x/sys/unix"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// execEndTimeout is how long Exec streams are kept open after sending the exit code, for clients to end them
+const execEndTimeout = time.Second
+
+// execStream sends the responses of an Exec stream, from multiple goroutines
+type execStream struct {
+	sync.Mutex
+
+	stream api.TaskService_ExecServer
+}
+
+func (s *execStream) send(resp *api.ExecResponse) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.stream.Send(resp)
+}
+
+// execWriter sends what is written to it as the stdout, or stderr, of an Exec stream
+type execWriter struct {
+	stream *execStream
+	stderr bool
+}
+
+func (w *execWriter) Write(p []byte) (int, error) {
+	// The stream might hold on to the message after Send returns
+	data := append([]byte(nil), p...)
+
+	resp := &api.ExecResponse{Msg: &api.ExecResponse_Stdout{data}}
+	if w.stderr {
+		resp.Msg = &api.ExecResponse_Stderr{data}
+	}
+
+	if err := w.stream.send(resp); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// resizeTerminal resizes terminal to size, if it is set
+func resizeTerminal(terminal console.Console, size *api.TerminalSize) error {
+	if size == nil {
+		return nil
+	}
+
+	return terminal.Resize(console.WinSize{Height: uint16(size.Rows), Width: uint16(size.Cols)})
+}
+
+// execProcess creates the libcontainer Process of an ExecStart, run like task
+func execProcess(task *Task, start *api.ExecStart) *libcontainer.Process {
+	user := task.Request.User
+	if user == "" {
+		user = "root"
+	}
+
+	return &libcontainer.Process{
+		Args: append([]string{start.Command}, start.Args...),
+		Env:  env(append(append([]string{}, task.Request.Env...), start.Env...)),
+		User: user,
+		Cwd:  task.Request.WorkingDir,
+	}
+}
+
+// execIO is how the input and output of an exec'd process is connected
+type execIO struct {
+	// stdin of the process
+	stdin io.WriteCloser
+
+	// terminal of the process, nil unless it has a TTY
+	terminal console.Console
+
+	// copying is done once all the output of the process has been sent
+	copying sync.WaitGroup
+
+	// closers are closed once the process has exited
+	closers []io.Closer
+}
+
+// close closes everything once the process has exited
+func (e *execIO) close() {
+	for _, closer := range e.closers {
+		closer.Close()
+	}
+}
+
+// copyOutput sends everything read from r to stream, as stdout or stderr
+func (e *execIO) copyOutput(r io.Reader, stream *execStream, stderr bool) {
+	e.copying.Add(1)
+	go func() {
+		defer e.copying.Done()
+		io.Copy(&execWriter{stream, stderr}, r)
+	}()
+}
+
+// runTTY starts process in container, in a terminal whose output is sent to stream
+func runTTY(container libcontainer.Container, process *libcontainer.Process, start *api.ExecStart, stream *execStream) (*execIO, error) {
+	parent, child, err := utils.NewSockPair("console")
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+	defer child.Close()
+
+	process.ConsoleSocket = child
+
+	if err := container.Run(process); err != nil {
+		return nil, err
+	}
+
+	// The master of the terminal is sent back by the container
+	master, err := utils.RecvFd(parent)
+	if err != nil {
+		process.Signal(unix.SIGKILL)
+		return nil, err
+	}
+
+	terminal, err := console.ConsoleFromFile(master)
+	if err != nil {
+		master.Close()
+		process.Signal(unix.SIGKILL)
+		return nil, err
+	}
+
+	if err := resizeTerminal(terminal, start.Size); err != nil {
+		terminal.Close()
+		process.Signal(unix.SIGKILL)
+		return nil, err
+	}
+
+	e := &execIO{stdin: terminal, terminal: terminal, closers: []io.Closer{terminal}}
+	e.copyOutput(terminal, stream, false)
+
+	return e, nil
+}
+
+// runPipes starts process in container, with pipes for its input and output, whose output is sent to stream
+func runPipes(container libcontainer.Container, process *libcontainer.Process, stream *execStream) (*execIO, error) {
+	// Use real files, so waiting for the process doesn't wait for its stdin to be closed
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	process.Stdin = stdinR
+	process.Stdout = stdoutW
+	process.Stderr = stderrW
+
+	err = container.Run(process)
+
+	// The process has its own copies of its ends
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, err
+	}
+
+	e := &execIO{stdin: stdinW, closers: []io.Closer{stdinW, stdoutR, stderrR}}
+	e.copyOutput(stdoutR, stream, false)
+	e.copyOutput(stderrR, stream, true)
+
+	return e, nil
+}
+
+// forwardInput forwards the input of an Exec stream to a process, until the stream ends.
+// process is killed if the stream fails (eg is canceled), unless exited is closed.
+func forwardInput(stream api.TaskService_ExecServer, process *libcontainer.Process, e *execIO, exited <-chan struct{}) {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			select {
+			case <-exited:
+				// The process has already been reaped
+			default:
+				process.Signal(unix.SIGKILL)
+			}
+			return
+		}
+
+		switch msg := req.Msg.(type) {
+		case *api.ExecRequest_Stdin:
+			e.stdin.Write(msg.Stdin)
+
+		case *api.ExecRequest_CloseStdin:
+			if e.terminal != nil {
+				// Closing the terminal would close the output, send EOF instead
+				e.stdin.Write([]byte{4})
+			} else {
+				e.stdin.Close()
+			}
+
+		case *api.ExecRequest_Resize:
+			if e.terminal != nil {
+				resizeTerminal(e.terminal, msg.Resize)
+			}
+		}
+	}
+}
+
+// execTask starts a process in the container of a task running on this node, streaming its input and output over stream.
+func execTask(stream api.TaskService_ExecServer, container libcontainer.Container, task *Task, start *api.ExecStart) error {
+	process := execProcess(task, start)
+	out := &execStream{stream: stream}
+
+	var e *execIO
+	var err error
+	if start.Tty {
+		e, err = runTTY(container, process, start, out)
+	} else {
+		e, err = runPipes(container, process, out)
+	}
+	if err != nil {
+		return fmt.Errorf("error starting process: %s", err)
+	}
+
+	exited := make(chan struct{})
+	forwarding := make(chan struct{})
+	go func() {
+		defer close(forwarding)
+		forwardInput(stream, process, e, exited)
+	}()
+
+	state, waitErr := process.Wait()
+	close(exited)
+
+	// Output is readable until every process holding it has exited, send all of it before the exit code
+	e.copying.Wait()
+	e.close()
+
+	// Wait returns errors if exit_code != 0, see runTask()
+	if state == nil && waitErr != nil {
+		return fmt.Errorf("error waiting for process: %s", waitErr)
+	}
+
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return fmt.Errorf("error getting process exit code")
+	}
+
+	if err := out.send(&api.ExecResponse{Msg: &api.ExecResponse_ExitCode{exitCode(status)}}); err != nil {
+		return err
+	}
+
+	// Give the client a chance to end the stream once it has the exit code, but don't wait on it.
+	// Once we return the stream is canceled, and forwardInput stops.
+	select {
+	case <-forwarding:
+	case <-stream.Context().Done():
+	case <-time.After(execEndTimeout):
+	}
+
+	return nil
+}
+
+// exitCode returns the exit code of a process, 128 + the signal that killed it like shells if it was
+func exitCode(status syscall.WaitStatus) int32 {
+	if status.Signaled() {
+		return 128 + int32(status.Signal())
+	}
+
+	return int32(status.ExitStatus())
+}
+
+// proxyExec forwards an Exec stream, whose first request was start, to the node running the task
+func proxyExec(stream api.TaskService_ExecServer, node *api.NodeID, start *api.ExecRequest) error {
+	client, conn, err := nodeClient(node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	remote, err := client.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := remote.Send(start); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				remote.CloseSend()
+				return
+			}
+			if err != nil {
+				cancel()
+				return
+			}
+
+			if err := remote.Send(req); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		resp, err := remote.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
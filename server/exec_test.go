@@ -0,0 +1,24 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+// TestExitCode tests processes killed by a signal exit with 128 + the signal
+func TestExitCode(t *testing.T) {
+	for status, expected := range map[syscall.WaitStatus]int32{
+		// Exited with 0
+		0: 0,
+		// Exited with 3
+		3 << 8: 3,
+		// Killed by SIGKILL
+		syscall.WaitStatus(syscall.SIGKILL): 137,
+		// Killed by SIGTERM, with a core dump
+		syscall.WaitStatus(syscall.SIGTERM) | 0x80: 143,
+	} {
+		if code := exitCode(status); code != expected {
+			t.Errorf("exitCode(%#x) = %d, expected %d", uint32(status), code, expected)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+
+	"github.com/arthurfabre/scheduler/api"
+	"github.com/arthurfabre/scheduler/files"
+)
+
+// defaultFileMode is the mode of files sent without one
+const defaultFileMode = 0644
+
+// checkFilePath ensures name is the absolute path of a file
+func checkFilePath(name string) error {
+	if !path.IsAbs(name) {
+		return fmt.Errorf("FileChunk field path must be an absolute path")
+	}
+
+	if path.Clean(name) == "/" {
+		return fmt.Errorf("FileChunk field path must name a file")
+	}
+
+	return nil
+}
+
+// fileWriter writes a stream of FileChunks to the files they belong to, under a root directory
+type fileWriter struct {
+	root string
+
+	// mapRoot chowns the files and directories created to the host ids of root in containers
+	mapRoot bool
+
+	// file being written, nil before the first chunk
+	file *os.File
+}
+
+// write writes chunk, creating the file it belongs to if it is the first chunk of it
+func (w *fileWriter) write(chunk *api.FileChunk) error {
+	if chunk.Path != "" {
+		if err := w.close(); err != nil {
+			return err
+		}
+
+		if err := w.create(chunk.Path, chunk.Mode); err != nil {
+			return err
+		}
+	}
+
+	if w.file == nil {
+		return fmt.Errorf("first FileChunk of a file missing required field path")
+	}
+
+	if _, err := w.file.Write(chunk.Data); err != nil {
+		return fmt.Errorf("error writing file: %s", err)
+	}
+
+	return nil
+}
+
+// create creates the file name, relative to the root, and its parent directories
+func (w *fileWriter) create(name string, mode uint32) error {
+	if err := checkFilePath(name); err != nil {
+		return err
+	}
+
+	// Symlinks can't point outside of the root
+	target, err := securejoin.SecureJoin(w.root, name)
+	if err != nil {
+		return fmt.Errorf("error resolving file path: %s", err)
+	}
+
+	// Directories that don't exist yet, from the deepest
+	var dirs []string
+	for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("error creating file directory: %s", err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating file directory: %s", err)
+	}
+
+	for _, dir := range dirs {
+		if err := w.chown(dir); err != nil {
+			return fmt.Errorf("error setting directory owner: %s", err)
+		}
+	}
+
+	perm := os.FileMode(mode) & os.ModePerm
+	if perm == 0 {
+		perm = defaultFileMode
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("error creating file: %s", err)
+	}
+
+	// The mode of OpenFile is subject to our umask
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return fmt.Errorf("error setting file mode: %s", err)
+	}
+
+	if err := w.chown(target); err != nil {
+		file.Close()
+		return fmt.Errorf("error setting file owner: %s", err)
+	}
+
+	w.file = file
+
+	return nil
+}
+
+// chown sets the owner of name to the host ids of root in containers, if mapRoot is set
+func (w *fileWriter) chown(name string) error {
+	if !w.mapRoot {
+		return nil
+	}
+
+	root, err := hostID(0)
+	if err != nil {
+		return err
+	}
+
+	return os.Lchown(name, root, root)
+}
+
+// close closes the file being written, if any
+func (w *fileWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("error closing file: %s", err)
+	}
+
+	return nil
+}
+
+// receiveFiles writes the FileChunks returned by recv with w, until it returns io.EOF
+func receiveFiles(w *fileWriter, recv func() (*api.FileChunk, error)) error {
+	defer w.close()
+
+	for {
+		chunk, err := recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := w.write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return w.close()
+}
+
+// sendFiles sends the regular files under name, a file or directory relative to root, as FileChunks.
+// The path of every file is its absolute path relative to root.
+// Files are opened without following symlinks, so a running task can't swap them for ones outside of root.
+func sendFiles(root string, name string, send func(*api.FileChunk) error) error {
+	if !path.IsAbs(name) {
+		return fmt.Errorf("path %s must be absolute", name)
+	}
+	name = path.Clean(name)
+
+	// Symlinks can't point outside of the root
+	resolved, err := securejoin.SecureJoin(root, name)
+	if err != nil {
+		return fmt.Errorf("error resolving path: %s", err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return fmt.Errorf("error resolving path: %s", err)
+	}
+
+	file, err := openInRoot(root, rel)
+	// Don't leak the location of root in errors
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s doesn't exist", name)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", name, err)
+	}
+
+	return sendOpenFiles(file, name, send)
+}
+
+// openInRoot opens rel, a path relative to root without any symlinks, one component at a time.
+// Fails if any component is a symlink.
+func openInRoot(root string, rel string) (*os.File, error) {
+	file, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if rel == "." {
+		return file, nil
+	}
+
+	for _, component := range strings.Split(filepath.ToSlash(rel), "/") {
+		next, err := openAt(file, component)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		file = next
+	}
+
+	return file, nil
+}
+
+// openAt opens name in the directory dir for reading, without following it if it is a symlink
+func openAt(dir *os.File, name string) (*os.File, error) {
+	// Opening FIFOs for reading would block until they have a writer
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// sendOpenFiles sends file, a regular file or directory, as FileChunks with name as its path. Closes file.
+func sendOpenFiles(file *os.File, name string, send func(*api.FileChunk) error) error {
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %s", err)
+	}
+
+	// Directories are created implicitly, everything else can't be sent
+	if info.Mode().IsRegular() {
+		return files.Send(file, name, info.Mode(), send)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	entries, err := file.Readdirnames(-1)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %s", err)
+	}
+	sort.Strings(entries)
+
+	for _, entry := range entries {
+		// Only open regular files and directories, opening anything else can have side effects
+		var stat unix.Stat_t
+		if err := unix.Fstatat(int(file.Fd()), entry, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fmt.Errorf("error getting file info: %s", err)
+		}
+		if mode := stat.Mode & unix.S_IFMT; mode != unix.S_IFREG && mode != unix.S_IFDIR {
+			continue
+		}
+
+		child, err := openAt(file, entry)
+		if err != nil {
+			return fmt.Errorf("error opening file: %s", err)
+		}
+
+		if err := sendOpenFiles(child, path.Join(name, entry), send); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// TestSendReceiveFiles tests files sent from one directory are written to another
+func TestSendReceiveFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := os.MkdirAll(filepath.Join(src, "data/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "data/sub/hello"), []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "data/empty"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &fileWriter{root: dst}
+	if err := sendFiles(src, "/data", w.write); err != nil {
+		t.Fatalf("Unexpected error sending files: %v", err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("Unexpected error closing file: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "data/sub/hello"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("Expected data/sub/hello to be copied, got %q (%v)", content, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "data/sub/hello"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected data/sub/hello to keep its mode, got %v (%v)", info, err)
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "data/empty"))
+	if err != nil || info.Size() != 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected empty data/empty to be copied, got %v (%v)", info, err)
+	}
+}
+
+// TestWriteFileMapRoot tests files and the directories created for them can be owned by root in containers
+func TestWriteFileMapRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing file owners requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &fileWriter{root: dir, mapRoot: true}
+	if err := w.write(&api.FileChunk{Path: "/data/hello", Data: []byte("hello")}); err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("Unexpected error closing file: %v", err)
+	}
+
+	for _, name := range []string{"data", "data/hello"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stat := info.Sys().(*syscall.Stat_t); stat.Uid != idMapHostID || stat.Gid != idMapHostID {
+			t.Errorf("Expected %s to be owned by the mapped root, got %d:%d", name, stat.Uid, stat.Gid)
+		}
+	}
+
+	// The root itself is left alone
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 {
+		t.Errorf("Expected root directory to keep its owner, got %d", stat.Uid)
+	}
+}
+
+// TestWriteFileEscape tests files can't be written outside of the root
+func TestWriteFileEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Absolute symlinks are resolved relative to the root
+	if err := os.Symlink(dir, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &fileWriter{root: root}
+	defer w.close()
+
+	for _, name := range []string{"/../escaped", "/link/escaped"} {
+		if err := w.write(&api.FileChunk{Path: name, Data: []byte("escaped")}); err != nil {
+			t.Fatalf("Unexpected error writing %s: %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("Expected file not to be written outside of the root")
+	}
+
+	if err := w.write(&api.FileChunk{Path: "relative"}); err == nil {
+		t.Errorf("Expected error writing relative path")
+	}
+
+	if err := (&fileWriter{root: root}).write(&api.FileChunk{Data: []byte("data")}); err == nil {
+		t.Errorf("Expected error writing chunk without path")
+	}
+}
+
+// TestSendFilesSymlinks tests files outside of the root aren't sent, even if a path is swapped for a symlink after resolving it
+func TestSendFilesSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinks and FIFOs in directories are skipped
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "data/secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "data/fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []*api.FileChunk
+	send := func(chunk *api.FileChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	}
+
+	if err := sendFiles(root, "/data", send); err != nil {
+		t.Fatalf("Unexpected error sending files: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("Expected no files to be sent, got %v", chunks)
+	}
+
+	// A component swapped for a symlink once resolved isn't followed
+	if err := os.Symlink(dir, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := openInRoot(root, "link/secret"); err == nil {
+		file.Close()
+		t.Errorf("Expected error opening path through symlink")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/satori/go.uuid"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// Prefix of the election used to pick the node that collects finished tasks
+const gcElectionPrefix = "gc/"
+
+// minInputAge is how long input files are kept for before their task is queued
+const minInputAge = 10 * time.Minute
+
+// retention is how long finished tasks are kept for, by status. 0 keeps them forever.
+type retention struct {
+	complete time.Duration
+	canceled time.Duration
+	failed   time.Duration
+	timedOut time.Duration
+}
+
+// Collector deletes finished tasks once they're older than their retention.
+// Only one node collects tasks from etcd at a time, every node removes its own orphaned log files.
+type Collector struct {
+	client *clientv3.Client
+	id     *api.NodeID
+
+	// interval between collections
+	interval time.Duration
+
+	// retention of finished tasks
+	retention retention
+}
+
+// collectTasks deletes every task done with status prefix at least age ago.
+func (c *Collector) collectTasks(ctx context.Context, prefix func(int64) string, age time.Duration) error {
+	if age == 0 {
+		return nil
+	}
+
+	tasks, err := listDoneTasks(ctx, c.client, prefix, int64(age.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	for _, taskEvent := range tasks {
+		switch taskEvent.(type) {
+		case TaskUpdate:
+			task := taskEvent.(TaskUpdate).task
+
+			switch err := task.delete(ctx, c.client); err {
+			case nil:
+				// The log file and layer are only stored on the node that ran the task, other nodes remove them with removeOrphans()
+				if err := os.Remove(getLog(task.Id)); err != nil && !os.IsNotExist(err) {
+					log.Println("Error removing task log:", err)
+				}
+				if err := removeLayer(getLayer(task.Id)); err != nil {
+					log.Println("Error removing task layer:", err)
+				}
+			case ConcurrentTaskModErr:
+				// Task was modified since we listed it, it'll be collected again later if need be
+			default:
+				log.Println("Error deleting task:", err)
+			}
+
+		case TaskError:
+			log.Println("Error listing finished tasks:", taskEvent.(TaskError).err)
+		}
+	}
+
+	return nil
+}
+
+// collect deletes all the finished tasks that have outlived their retention.
+func (c *Collector) collect(ctx context.Context) error {
+	if err := c.collectTasks(ctx, completePrefix, c.retention.complete); err != nil {
+		return fmt.Errorf("error collecting complete tasks: %s", err)
+	}
+
+	if err := c.collectTasks(ctx, canceledPrefix, c.retention.canceled); err != nil {
+		return fmt.Errorf("error collecting canceled tasks: %s", err)
+	}
+
+	if err := c.collectTasks(ctx, failedPrefix, c.retention.failed); err != nil {
+		return fmt.Errorf("error collecting failed tasks: %s", err)
+	}
+
+	if err := c.collectTasks(ctx, timedOutPrefix, c.retention.timedOut); err != nil {
+		return fmt.Errorf("error collecting timed out tasks: %s", err)
+	}
+
+	return nil
+}
+
+// orphans returns the tasks that no longer exist, out of the tasks entries in dir are named after.
+// Only directories are considered if dirs is true, only files otherwise. Entries modified less than minAge ago are skipped.
+func (c *Collector) orphans(ctx context.Context, dir string, dirs bool, minAge time.Duration) ([]*api.TaskID, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []*api.TaskID
+
+	for _, file := range files {
+		if file.IsDir() != dirs {
+			continue
+		}
+		if _, err := uuid.FromString(file.Name()); err != nil {
+			continue
+		}
+		if time.Since(file.ModTime()) < minAge {
+			continue
+		}
+
+		id := &api.TaskID{Uuid: file.Name()}
+
+		resp, err := c.client.Get(ctx, taskKey(id), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Count == 0 {
+			orphans = append(orphans, id)
+		}
+	}
+
+	return orphans, nil
+}
+
+// removeOrphans removes the log files in logDir, the layers in layerDir, and the input files in inputDir, of tasks that no longer exist.
+func (c *Collector) removeOrphans(ctx context.Context, logDir string, layerDir string, inputDir string) error {
+	// Log files are named after the UUID of their task
+	logs, err := c.orphans(ctx, logDir, false, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range logs {
+		if err := os.Remove(getLog(id)); err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing task log:", err)
+		}
+	}
+
+	// Layers are directories named after the UUID of their task
+	layers, err := c.orphans(ctx, layerDir, true, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range layers {
+		if err := removeLayer(getLayer(id)); err != nil {
+			log.Println("Error removing task layer:", err)
+		}
+	}
+
+	// Input files are in directories named after the UUID of their task, stored just before it's queued
+	inputs, err := c.orphans(ctx, inputDir, true, minInputAge)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range inputs {
+		if err := os.RemoveAll(getInputs(id)); err != nil {
+			log.Println("Error removing task input files:", err)
+		}
+	}
+
+	return nil
+}
+
+// lead collects tasks every interval, as long as we're the leader of session.
+func (c *Collector) lead(ctx context.Context, session *concurrency.Session) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// campaign waits to be elected as the node collecting tasks, and collects them until leadership is lost.
+func (c *Collector) campaign(ctx context.Context) error {
+	session, err := concurrency.NewSession(c.client, concurrency.WithTTL(nodeTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error creating gc session: %s", err)
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, gcElectionPrefix)
+
+	if err := election.Campaign(ctx, c.id.Uuid); err != nil {
+		return fmt.Errorf("error campaigning to collect tasks: %s", err)
+	}
+
+	log.Println("Elected to collect finished tasks")
+
+	c.lead(ctx, session)
+
+	// Let someone else take over if we're stopping
+	return election.Resign(context.Background())
+}
+
+// Run collects finished tasks and their logs, layers and input files. Blocking.
+func (c *Collector) Run(ctx context.Context, logDir string, layerDir string, inputDir string) error {
+	// Every node cleans up its own logs, layers and input files
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.removeOrphans(ctx, logDir, layerDir, inputDir); err != nil && ctx.Err() == nil {
+				log.Println("Error removing logs, layers and input files of deleted tasks:", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		err := c.campaign(ctx)
+		if err == nil {
+			backoff = minBackoff
+			continue
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Println(err)
+
+		sleep(ctx, backoff)
+		backoff = nextBackoff(backoff)
+	}
+
+	return nil
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// Subdirectories of the image store
+const (
+	// imageLayersDir holds unpacked layers, by digest
+	imageLayersDir = "layers"
+
+	// imageRefsDir holds images, by name
+	imageRefsDir = "images"
+
+	// imageTmpDir holds imports in progress
+	imageTmpDir = "tmp"
+)
+
+// Parts of the OCI image layout and image spec we use
+// See https://github.com/opencontainers/image-spec
+const (
+	ociIndexFile   = "index.json"
+	ociBlobsDir    = "blobs"
+	ociRefNameAnno = "org.opencontainers.image.ref.name"
+
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Layer whiteouts, converted to their overlayfs equivalents when unpacked
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// digestRegexp matches the digests we support
+var digestRegexp = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+
+// ociDescriptor references a blob of an OCI image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociIndex is the index.json of an OCI image layout
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// image is an image of the store
+type image struct {
+	// Name the image was imported as
+	Name string `json:"name"`
+
+	// Digest of the image manifest
+	Digest string `json:"digest"`
+
+	// Digests of the layers of the image, from the bottom most
+	Layers []string `json:"layers"`
+}
+
+// imageStore is a node local store of OCI images, with layers unpacked so they can be used as overlayfs lower dirs.
+type imageStore struct {
+	// Serializes imports
+	sync.Mutex
+
+	dir string
+
+	// imported is signaled when an image is imported, so tasks that need it can be run
+	imported chan struct{}
+}
+
+// newImageStore creates an image store in dir
+func newImageStore(dir string) (*imageStore, error) {
+	for _, subDir := range []string{imageLayersDir, imageRefsDir, imageTmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0700); err != nil {
+			return nil, fmt.Errorf("error creating image store: %s", err)
+		}
+	}
+
+	return &imageStore{dir: dir, imported: make(chan struct{}, 1)}, nil
+}
+
+// checkDigest ensures a digest is supported, and safe to use as a path
+func checkDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("unsupported digest %s", digest)
+	}
+
+	return nil
+}
+
+// digestPath returns the path of a digest under dir
+func digestPath(dir string, digest string) string {
+	return filepath.Join(dir, strings.Replace(digest, ":", "/", 1))
+}
+
+// imagePath returns the path of the image with name
+func (s *imageStore) imagePath(name string) string {
+	return filepath.Join(s.dir, imageRefsDir, url.PathEscape(name))
+}
+
+// get returns the image with name
+func (s *imageStore) get(name string) (*image, error) {
+	data, err := ioutil.ReadFile(s.imagePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	img := &image{}
+	if err := json.Unmarshal(data, img); err != nil {
+		return nil, fmt.Errorf("error parsing image %s: %s", name, err)
+	}
+
+	return img, nil
+}
+
+// has returns true if the store has the image with name
+func (s *imageStore) has(name string) bool {
+	_, err := os.Stat(s.imagePath(name))
+	return err == nil
+}
+
+// list returns every image of the store
+func (s *imageStore) list() ([]*image, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, imageRefsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*image
+
+	for _, file := range files {
+		name, err := url.PathUnescape(file.Name())
+		if err != nil {
+			continue
+		}
+
+		img, err := s.get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+// lowerDirs returns the unpacked layers of the image with name, from the top most, to be used as overlayfs lower dirs
+func (s *imageStore) lowerDirs(name string) ([]string, error) {
+	img, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, len(img.Layers))
+	for i, layer := range img.Layers {
+		dirs[len(dirs)-1-i] = digestPath(filepath.Join(s.dir, imageLayersDir), layer)
+	}
+
+	return dirs, nil
+}
+
+// importArchive imports the images of an OCI image layout tarball.
+// Images are named after their ref name annotation, or name if the archive only contains one image.
+func (s *imageStore) importArchive(archive io.Reader, name string) ([]*image, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	layout, err := ioutil.TempDir(filepath.Join(s.dir, imageTmpDir), "layout")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(layout)
+
+	if err := extractLayout(archive, layout); err != nil {
+		return nil, fmt.Errorf("error extracting image archive: %s", err)
+	}
+
+	indexData, err := ioutil.ReadFile(filepath.Join(layout, ociIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading image index: %s", err)
+	}
+
+	index := &ociIndex{}
+	if err := json.Unmarshal(indexData, index); err != nil {
+		return nil, fmt.Errorf("error parsing image index: %s", err)
+	}
+
+	if name != "" && len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("image archive has %d images, can't name them all %s", len(index.Manifests), name)
+	}
+
+	var images []*image
+
+	for _, desc := range index.Manifests {
+		img, err := s.importManifest(layout, desc, name)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, img)
+	}
+
+	select {
+	case s.imported <- struct{}{}:
+	default:
+	}
+
+	return images, nil
+}
+
+// importManifest imports the image with manifest desc of an extracted OCI image layout.
+func (s *imageStore) importManifest(layout string, desc ociDescriptor, name string) (*image, error) {
+	if desc.MediaType != ociManifestMediaType && desc.MediaType != dockerManifestMediaType {
+		return nil, fmt.Errorf("unsupported image manifest type %s", desc.MediaType)
+	}
+
+	if name == "" {
+		name = desc.Annotations[ociRefNameAnno]
+	}
+	if err := checkImageName(name); err != nil {
+		return nil, err
+	}
+
+	manifestData, err := readBlob(layout, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, fmt.Errorf("error parsing image manifest: %s", err)
+	}
+
+	// overlayfs needs at least one lower dir
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("image %s has no layers", name)
+	}
+
+	img := &image{Name: name, Digest: desc.Digest}
+
+	for _, layer := range manifest.Layers {
+		if err := s.importLayer(layout, layer.Digest); err != nil {
+			return nil, err
+		}
+
+		img.Layers = append(img.Layers, layer.Digest)
+	}
+
+	data, err := json.Marshal(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace any previous image with the same name atomically, tasks might be using it
+	tmp := filepath.Join(layout, "image")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, s.imagePath(name)); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// importLayer unpacks the layer blob with digest of an extracted OCI image layout, unless it already has been.
+func (s *imageStore) importLayer(layout string, digest string) error {
+	if err := checkDigest(digest); err != nil {
+		return err
+	}
+
+	layerDir := digestPath(filepath.Join(s.dir, imageLayersDir), digest)
+	if _, err := os.Stat(layerDir); err == nil {
+		return nil
+	}
+
+	blob, err := os.Open(digestPath(filepath.Join(layout, ociBlobsDir), digest))
+	if err != nil {
+		return fmt.Errorf("error opening layer: %s", err)
+	}
+	defer blob.Close()
+
+	// Unpack next to the final location, so it can be renamed atomically
+	if err := os.MkdirAll(filepath.Dir(layerDir), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(layerDir), "unpack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	digester := sha256.New()
+
+	layer, err := decompress(io.TeeReader(blob, digester))
+	if err != nil {
+		return fmt.Errorf("error reading layer %s: %s", digest, err)
+	}
+
+	if err := unpackLayer(layer, tmp); err != nil {
+		return fmt.Errorf("error unpacking layer %s: %s", digest, err)
+	}
+
+	// The tar might end before the blob
+	if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+		return err
+	}
+	if _, err := io.Copy(digester, blob); err != nil {
+		return err
+	}
+
+	if err := verifyDigest(digester, digest); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, layerDir)
+}
+
+// readBlob reads the blob with digest of an extracted OCI image layout, verifying its digest
+func readBlob(layout string, digest string) ([]byte, error) {
+	if err := checkDigest(digest); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(digestPath(filepath.Join(layout, ociBlobsDir), digest))
+	if err != nil {
+		return nil, err
+	}
+
+	digester := sha256.New()
+	digester.Write(data)
+
+	if err := verifyDigest(digester, digest); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// verifyDigest ensures the content hashed by digester matches digest
+func verifyDigest(digester hash.Hash, digest string) error {
+	if actual := "sha256:" + hex.EncodeToString(digester.Sum(nil)); actual != digest {
+		return fmt.Errorf("digest mismatch, expected %s got %s", digest, actual)
+	}
+
+	return nil
+}
+
+// decompress returns a reader of r, decompressed if it's gzipped
+func decompress(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+
+	return buf, nil
+}
+
+// extractLayout extracts the regular files of an OCI image layout tarball to dir
+func extractLayout(archive io.Reader, dir string) error {
+	r, err := decompress(archive)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// Rooting the name stops it from escaping dir
+		path := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unpackLayer unpacks a layer tarball to root, converting whiteouts to their overlayfs equivalents
+func unpackLayer(layer io.Reader, root string) error {
+	tr := tar.NewReader(layer)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dir, base := filepath.Split(filepath.Clean("/" + hdr.Name))
+
+		// Resolve symlinks of the layer within root, so entries can't be written outside of it
+		parent, err := securejoin.SecureJoin(root, dir)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+
+		if base == whiteoutOpaque {
+			if err := unix.Setxattr(parent, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+				return fmt.Errorf("error creating opaque whiteout: %s", err)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			path := filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("error creating whiteout: %s", err)
+			}
+			continue
+		}
+
+		path := filepath.Join(parent, base)
+
+		if err := unpackEntry(tr, hdr, root, path); err != nil {
+			return err
+		}
+	}
+}
+
+// unpackEntry creates the file described by hdr at path, whose content is read from tr
+func unpackEntry(tr *tar.Reader, hdr *tar.Header, root string, path string) error {
+	mode := hdr.FileInfo().Mode()
+
+	// Replace anything but directories from lower layers
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		target, err := securejoin.SecureJoin(root, filepath.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+
+		if err := unix.Mknod(path, fileType|uint32(mode.Perm()), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+
+	default:
+		// Nothing to create for other entries (eg PAX headers)
+		return nil
+	}
+
+	// Owners are ids in the container, shift them so they're mapped to the same ids in tasks
+	uid, err := hostID(hdr.Uid)
+	if err != nil {
+		return fmt.Errorf("error mapping owner of %s: %s", hdr.Name, err)
+	}
+	gid, err := hostID(hdr.Gid)
+	if err != nil {
+		return fmt.Errorf("error mapping group of %s: %s", hdr.Name, err)
+	}
+
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return err
+	}
+
+	// Chown clears setuid / setgid bits, so chmod after. Symlinks don't have permissions.
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
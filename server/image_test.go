@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// tarball creates a tarball of regular files, owned by root
+func tarball(t *testing.T, files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// sha256Digest returns the digest of data
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ociArchive creates an OCI image layout tarball of a single image named name with layers
+func ociArchive(t *testing.T, name string, layers ...[]byte) []byte {
+	descs := []ociDescriptor{}
+	for _, layer := range layers {
+		descs = append(descs, ociDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: sha256Digest(layer)})
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"layers":        descs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := json.Marshal(ociIndex{Manifests: []ociDescriptor{{
+		MediaType:   ociManifestMediaType,
+		Digest:      sha256Digest(manifest),
+		Annotations: map[string]string{ociRefNameAnno: name},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"oci-layout": []byte(`{"imageLayoutVersion": "1.0.0"}`),
+		ociIndexFile: index,
+		digestPath(ociBlobsDir, sha256Digest(manifest)): manifest,
+	}
+	for _, layer := range layers {
+		files[digestPath(ociBlobsDir, sha256Digest(layer))] = layer
+	}
+
+	return tarball(t, files)
+}
+
+// TestImportArchive tests images are imported and their layers unpacked
+func TestImportArchive(t *testing.T) {
+	// Layers are chowned to the ids mapped in containers
+	if os.Geteuid() != 0 {
+		t.Skip("Importing images requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := tarball(t, map[string][]byte{"etc/hello": []byte("hello")})
+
+	images, err := store.importArchive(bytes.NewReader(ociArchive(t, "test:latest", layer)), "")
+	if err != nil {
+		t.Fatalf("Unexpected error importing archive: %v", err)
+	}
+
+	if len(images) != 1 || images[0].Name != "test:latest" {
+		t.Fatalf("Expected image test:latest to be imported, got %v", images)
+	}
+
+	if !store.has("test:latest") {
+		t.Errorf("Expected store to have imported image")
+	}
+
+	select {
+	case <-store.imported:
+	default:
+		t.Errorf("Expected import to be signaled")
+	}
+
+	dirs, err := store.lowerDirs("test:latest")
+	if err != nil {
+		t.Fatalf("Unexpected error getting image layers: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dirs[0], "etc/hello"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("Expected unpacked layer to contain etc/hello, got %q (%v)", content, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dirs[0], "etc/hello"))
+	if err != nil || info.Sys().(*syscall.Stat_t).Uid != idMapHostID {
+		t.Errorf("Expected root owned file to be owned by the mapped root")
+	}
+}
+
+// TestImportEmptyImage tests images without layers are rejected
+func TestImportEmptyImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := ociArchive(t, "empty")
+
+	if _, err := store.importArchive(bytes.NewReader(archive), ""); err == nil {
+		t.Errorf("Expected error importing image without layers")
+	}
+
+	if store.has("empty") {
+		t.Errorf("Expected image without layers not to be imported")
+	}
+}
+
+// TestImportCorruptArchive tests layers that don't match their digest are rejected
+func TestImportCorruptArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := ociArchive(t, "test:latest", tarball(t, map[string][]byte{"etc/hello": []byte("hello")}))
+
+	// Corrupt the content of the layer
+	archive = bytes.Replace(archive, []byte("hello"), []byte("world"), 1)
+
+	if _, err := store.importArchive(bytes.NewReader(archive), ""); err == nil {
+		t.Errorf("Expected error importing corrupt archive")
+	}
+
+	if store.has("test:latest") {
+		t.Errorf("Expected corrupt image not to be imported")
+	}
+}
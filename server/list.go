@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// Page sizes of List
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// keyRange is a range of etcd keys [start, end)
+type keyRange struct {
+	start string
+	end   string
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+// epochRange returns the range of status keys with prefix for tasks done between since and until (inclusive).
+// until may be 0 for no limit.
+func epochRange(prefix func(int64) string, since int64, until int64) keyRange {
+	// Without an upper bound, include every epoch
+	r := keyRange{start: prefix(since), end: prefixEnd(prefix(math.MaxInt64))}
+
+	if until != 0 {
+		r.end = prefix(until + 1)
+	}
+
+	return r
+}
+
+// listRanges returns the ranges of status keys that match req, in key order.
+func listRanges(req *api.ListRequest) []keyRange {
+	statuses := req.Status
+	if len(statuses) == 0 {
+		for status := range api.ListRequest_Status_name {
+			statuses = append(statuses, api.ListRequest_Status(status))
+		}
+	}
+
+	var ranges []keyRange
+
+	// Overlapping ranges would break paging, every status only gets one
+	seen := make(map[api.ListRequest_Status]bool)
+
+	for _, status := range statuses {
+		if seen[status] {
+			continue
+		}
+		seen[status] = true
+
+		switch status {
+		case api.ListRequest_QUEUED:
+			if req.NodeUuid == "" {
+				ranges = append(ranges, keyRange{queuedPrefix(), prefixEnd(queuedPrefix())})
+			}
+
+		case api.ListRequest_RUNNING:
+			prefix := allRunningPrefix()
+			if req.NodeUuid != "" {
+				prefix = runningPrefix(&api.NodeID{Uuid: req.NodeUuid})
+			}
+			ranges = append(ranges, keyRange{prefix, prefixEnd(prefix)})
+
+		case api.ListRequest_COMPLETE:
+			// Completed tasks are filtered by node once retrieved
+			ranges = append(ranges, epochRange(completePrefix, req.Since, req.Until))
+
+		case api.ListRequest_CANCELED:
+			if req.NodeUuid == "" {
+				ranges = append(ranges, epochRange(canceledPrefix, req.Since, req.Until))
+			}
+
+		case api.ListRequest_FAILED:
+			if req.NodeUuid == "" {
+				ranges = append(ranges, epochRange(failedPrefix, req.Since, req.Until))
+			}
+
+		case api.ListRequest_TIMED_OUT:
+			// Timed out tasks are filtered by node once retrieved
+			ranges = append(ranges, epochRange(timedOutPrefix, req.Since, req.Until))
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	return ranges
+}
+
+// listStatus returns the ListRequest_Status of a TaskStatus
+func listStatus(status *api.TaskStatus) api.ListRequest_Status {
+	switch status.Status.(type) {
+	case *api.TaskStatus_Running_:
+		return api.ListRequest_RUNNING
+	case *api.TaskStatus_Complete_:
+		return api.ListRequest_COMPLETE
+	case *api.TaskStatus_Canceled_:
+		return api.ListRequest_CANCELED
+	case *api.TaskStatus_Failed_:
+		return api.ListRequest_FAILED
+	case *api.TaskStatus_TimedOut_:
+		return api.ListRequest_TIMED_OUT
+	default:
+		return api.ListRequest_QUEUED
+	}
+}
+
+// matchesStatus returns true if status is one of statuses, or statuses is empty.
+func matchesStatus(status *api.TaskStatus, statuses []api.ListRequest_Status) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+
+	for _, s := range statuses {
+		if listStatus(status) == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesNode returns true if task is running, completed or timed out on the node with UUID nodeUuid, or nodeUuid is empty.
+func matchesNode(task *Task, nodeUuid string) bool {
+	if nodeUuid == "" {
+		return true
+	}
+
+	switch task.Status.Status.(type) {
+	case *api.TaskStatus_Running_:
+		return task.Status.GetRunning().NodeId.Uuid == nodeUuid
+	case *api.TaskStatus_Complete_:
+		return task.Status.GetComplete().NodeId.Uuid == nodeUuid
+	case *api.TaskStatus_TimedOut_:
+		return task.Status.GetTimedOut().NodeId.Uuid == nodeUuid
+	default:
+		return false
+	}
+}
+
+// encodePageToken converts the last status key of a page to a page token
+func encodePageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodePageToken converts a page token to the last status key of the previous page
+func decodePageToken(token string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid page token")
+	}
+
+	return string(key), nil
+}
+
+// listPage returns a page of the tasks matching req.
+func listPage(ctx context.Context, client clientv3.KV, req *api.ListRequest) (*api.ListResponse, error) {
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	// Resume after the last key of the previous page
+	var after string
+	if req.PageToken != "" {
+		var err error
+		if after, err = decodePageToken(req.PageToken); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &api.ListResponse{}
+
+	for _, r := range listRanges(req) {
+		if after != "" && r.end <= after {
+			continue
+		}
+		if after >= r.start {
+			// Smallest key after the last one
+			r.start = after + "\x00"
+		}
+
+		for r.start < r.end {
+			// Fetch one more than we need, so we know if there's another page
+			keys, err := client.Get(ctx, r.start, clientv3.WithRange(r.end), clientv3.WithKeysOnly(), clientv3.WithLimit(int64(pageSize-len(resp.Tasks)+1)))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, kv := range keys.Kvs {
+				key := string(kv.Key)
+
+				if len(resp.Tasks) == pageSize {
+					resp.NextPageToken = encodePageToken(after)
+					return resp, nil
+				}
+
+				after = key
+				r.start = key + "\x00"
+
+				task, err := getTask(ctx, client, taskID(key))
+				if err != nil {
+					// Task might have been deleted or changed status since we listed it
+					continue
+				}
+
+				// Skip tasks that have changed status since we listed them, we'll find them under their new status key
+				if task.statusKey(task.Status) != key || !matchesNode(task, req.NodeUuid) {
+					continue
+				}
+
+				resp.Tasks = append(resp.Tasks, &api.TaskInfo{Id: task.Id, Request: task.Request, Status: task.Status, Attempts: task.AttemptHistory})
+			}
+
+			if !keys.More {
+				break
+			}
+		}
+	}
+
+	return resp, nil
+}
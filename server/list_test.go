@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// TestListRanges tests status filters map to ordered, non-empty key ranges
+func TestListRanges(t *testing.T) {
+	ranges := listRanges(&api.ListRequest{})
+	if len(ranges) != len(api.ListRequest_Status_name) {
+		t.Fatalf("expected a range per status, got %v", ranges)
+	}
+
+	for i, r := range ranges {
+		if r.start >= r.end {
+			t.Errorf("empty range %v", r)
+		}
+		if i > 0 && ranges[i-1].end > r.start {
+			t.Errorf("overlapping ranges %v and %v", ranges[i-1], r)
+		}
+	}
+
+	// Only running, complete and timed out tasks can be on a node
+	ranges = listRanges(&api.ListRequest{NodeUuid: "foo"})
+	if len(ranges) != 3 {
+		t.Fatalf("expected running, complete and timed out ranges, got %v", ranges)
+	}
+
+	// Repeated statuses only get one range
+	ranges = listRanges(&api.ListRequest{Status: []api.ListRequest_Status{api.ListRequest_COMPLETE, api.ListRequest_QUEUED, api.ListRequest_COMPLETE}})
+	if len(ranges) != 2 {
+		t.Fatalf("expected complete and queued ranges, got %v", ranges)
+	}
+
+	// Done tasks are filtered by epoch
+	r := epochRange(completePrefix, 10, 20)
+	key := idKey(completePrefix(15), &api.TaskID{Uuid: "foo"})
+	if key < r.start || key >= r.end {
+		t.Errorf("expected %s in range %v", key, r)
+	}
+	key = idKey(completePrefix(21), &api.TaskID{Uuid: "foo"})
+	if key >= r.start && key < r.end {
+		t.Errorf("expected %s outside range %v", key, r)
+	}
+
+	// Epochs are compared as numbers, not strings
+	for _, c := range []struct {
+		since, until, epoch int64
+		in                  bool
+	}{
+		{999, 1000, 999, true},
+		{999, 1000, 1000, true},
+		{999, 1000, 99, false},
+		{999, 1000, 9999, false},
+		{999, 1000, 10000, false},
+		{1000, 0, 999, false},
+		{1000, 0, 10000, true},
+		{0, 999, 1000, false},
+		{0, 0, math.MaxInt64, true},
+	} {
+		r := epochRange(completePrefix, c.since, c.until)
+		key := idKey(completePrefix(c.epoch), &api.TaskID{Uuid: "foo"})
+		if in := key >= r.start && key < r.end; in != c.in {
+			t.Errorf("expected %s in range %v of %d to %d to be %v", key, r, c.since, c.until, c.in)
+		}
+	}
+}
+
+// TestPageToken tests page tokens round trip
+func TestPageToken(t *testing.T) {
+	key := idKey(queuedPrefix(), &api.TaskID{Uuid: "foo"})
+
+	decoded, err := decodePageToken(encodePageToken(key))
+	if err != nil || decoded != key {
+		t.Errorf("decodePageToken(encodePageToken(%s)) = %s, %v", key, decoded, err)
+	}
+
+	if _, err := decodePageToken(strings.Repeat("!", 4)); err == nil {
+		t.Errorf("expected error decoding invalid page token")
+	}
+}
+
+// TestMatchesStatus tests status filtering
+func TestMatchesStatus(t *testing.T) {
+	queued := &api.TaskStatus{&api.TaskStatus_Queued_{&api.TaskStatus_Queued{}}}
+
+	if !matchesStatus(queued, nil) {
+		t.Errorf("expected no filter to match")
+	}
+
+	if !matchesStatus(queued, []api.ListRequest_Status{api.ListRequest_RUNNING, api.ListRequest_QUEUED}) {
+		t.Errorf("expected queued filter to match")
+	}
+
+	if matchesStatus(queued, []api.ListRequest_Status{api.ListRequest_RUNNING}) {
+		t.Errorf("expected running filter not to match")
+	}
+}
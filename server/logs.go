@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// Prefix under which the log replicas of finished tasks are stored
+// See README/#ETCD Key Schema
+const logPrefix = "log/"
+
+// maxLogReplicaSize bounds log replicas, so they fit in a single etcd request (1.5MiB by default)
+const maxLogReplicaSize = 1024 * 1024
+
+// maxLogLineSize bounds the lines of log entries, longer lines are split into multiple entries
+const maxLogLineSize = 64 * 1024
+
+// taskLog writes the output of a task to its log file, one LogEntry per line.
+// Entries are stored as JSON, one per line of the file, with the line base64 encoded so it's kept byte for byte.
+type taskLog struct {
+	sync.Mutex
+
+	file *os.File
+
+	// offset of the next entry
+	offset uint64
+
+	// stdout and stderr of the task
+	stdout *logStream
+	stderr *logStream
+}
+
+// logStream buffers what a task writes to one of its output streams, until it has whole lines
+type logStream struct {
+	log    *taskLog
+	stream api.LogEntry_Stream
+
+	// buf holds the partial line written so far
+	buf []byte
+}
+
+// createTaskLog creates the log file of a task, truncating it if it exists. It must be closed.
+func createTaskLog(file string) (*taskLog, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &taskLog{file: f}
+	l.stdout = &logStream{log: l, stream: api.LogEntry_STDOUT}
+	l.stderr = &logStream{log: l, stream: api.LogEntry_STDERR}
+
+	return l, nil
+}
+
+// write appends an entry for line to the log
+func (l *taskLog) write(stream api.LogEntry_Stream, line []byte) error {
+	l.Lock()
+	defer l.Unlock()
+
+	data, err := json.Marshal(&api.LogEntry{
+		Stream:    stream,
+		TimeNanos: time.Now().UnixNano(),
+		Offset:    l.offset,
+		Line:      line,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.offset++
+
+	return nil
+}
+
+// close writes any partial lines left, and closes the log file. The task must have exited.
+func (l *taskLog) close() error {
+	for _, s := range []*logStream{l.stdout, l.stderr} {
+		if len(s.buf) > 0 {
+			if err := l.write(s.stream, s.buf); err != nil {
+				l.file.Close()
+				return err
+			}
+		}
+	}
+
+	return l.file.Close()
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+
+	lines := s.buf
+	for {
+		end, next := bytes.IndexByte(lines, '\n'), 0
+		switch {
+		case end != -1 && end <= maxLogLineSize:
+			next = end + 1
+		case len(lines) > maxLogLineSize:
+			end = runeStart(lines, maxLogLineSize)
+			next = end
+		}
+
+		// Wait for the rest of the line
+		if next == 0 {
+			break
+		}
+
+		if err := s.log.write(s.stream, lines[:end]); err != nil {
+			return 0, err
+		}
+		lines = lines[next:]
+	}
+
+	s.buf = append(s.buf[:0], lines...)
+
+	return len(p), nil
+}
+
+// runeStart returns the start of the UTF-8 character at pos in p, so p can be split there without splitting the character.
+// Returns pos if p isn't valid UTF-8 there.
+func runeStart(p []byte, pos int) int {
+	for i := pos; i > 0 && i > pos-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if r, size := utf8.DecodeRune(p[i:]); r == utf8.RuneError && size == 1 {
+				return pos
+			}
+			return i
+		}
+	}
+
+	return pos
+}
+
+// parseLogEntry parses a line of a log file.
+// Log files written before entries were stored as JSON have the output of the task as is, their lines are stdout entries.
+func parseLogEntry(line []byte) *api.LogEntry {
+	entry := &api.LogEntry{}
+
+	// Every entry has a time, output that happens to be JSON doesn't
+	if err := json.Unmarshal(line, entry); err != nil || entry.TimeNanos == 0 {
+		return &api.LogEntry{Stream: api.LogEntry_STDOUT, Line: line}
+	}
+
+	return entry
+}
+
+// logBlockSize is the size of the blocks log files are read backwards in, to find their tail
+const logBlockSize = 64 * 1024
+
+// matchesLogsRequest returns true if entry isn't before the ones req asks for
+func matchesLogsRequest(entry *api.LogEntry, req *api.LogsRequest) bool {
+	return entry.Offset >= req.SinceOffset && entry.TimeNanos >= req.SinceTimeNanos
+}
+
+// logStart returns the position in the log file of the first entry req asks for, without reading the file in full.
+// The entries from there still need to be filtered with matchesLogsRequest.
+func logStart(file string, req *api.LogsRequest) (int64, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		// The task hasn't started yet
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	start, err := tailStart(f, info.Size(), req.TailLines)
+	if err != nil {
+		return 0, err
+	}
+
+	if req.SinceOffset == 0 && req.SinceTimeNanos == 0 {
+		return start, nil
+	}
+
+	// Entries are written in order, so offsets and times only increase
+	since, err := firstEntry(f, info.Size(), func(entry *api.LogEntry) bool {
+		return matchesLogsRequest(entry, req)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if since > start {
+		return since, nil
+	}
+	return start, nil
+}
+
+// tailStart returns the position of the start of the last lines lines of f, of size bytes. 0 if lines is 0.
+func tailStart(f *os.File, size int64, lines uint32) (int64, error) {
+	if lines == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, logBlockSize)
+	found := uint32(0)
+
+	for end := size; end > 0; {
+		start := end - logBlockSize
+		if start < 0 {
+			start = 0
+		}
+
+		block := buf[:end-start]
+		if _, err := f.ReadAt(block, start); err != nil {
+			return 0, err
+		}
+
+		for i := len(block) - 1; i >= 0; i-- {
+			// The newline ending the last line doesn't start a line
+			if block[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+
+			found++
+			if found == lines {
+				return start + int64(i) + 1, nil
+			}
+		}
+
+		end = start
+	}
+
+	return 0, nil
+}
+
+// firstEntry binary searches for the position of the first entry of f, of size bytes, for which after returns true.
+// after must return false for every entry before it, and true for every entry from it. Returns size if there's none.
+func firstEntry(f *os.File, size int64, after func(*api.LogEntry) bool) (int64, error) {
+	// The entry is between lo and hi, lo is always the start of a line
+	lo, hi := int64(0), size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, line, err := lineAt(f, mid, hi)
+		if err != nil {
+			return 0, err
+		}
+
+		// No whole line starts between mid and hi
+		if line == nil {
+			hi = mid
+			continue
+		}
+
+		if after(parseLogEntry(line)) {
+			hi = start
+		} else {
+			lo = start + int64(len(line)) + 1
+		}
+	}
+
+	return lo, nil
+}
+
+// lineAt returns the first whole line of f starting at or after pos and before end, and its position.
+// line is nil if there is none.
+func lineAt(f *os.File, pos int64, end int64) (int64, []byte, error) {
+	// pos is the start of a line if it follows a newline, read from the byte before it
+	off := pos
+	if pos > 0 {
+		off = pos - 1
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, off, math.MaxInt64-off))
+
+	start := pos
+	if pos > 0 {
+		skipped, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return 0, nil, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		start = off + int64(len(skipped))
+	}
+
+	if start >= end {
+		return 0, nil, nil
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF {
+		// Partially written
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return start, line[:len(line)-1], nil
+}
+
+// logKey returns the etcd key of the log replica of a TaskID
+func logKey(id *api.TaskID) string {
+	return logPrefix + id.Uuid
+}
+
+// logTail reads at most size bytes from the end of file. If the file is longer, only whole lines (ie entries) are returned.
+func logTail(file string, size int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() <= size {
+		return ioutil.ReadAll(io.LimitReader(f, size))
+	}
+
+	// Read the byte before the tail too, to know if it starts on a line boundary
+	if _, err := f.Seek(info.Size()-size-1, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, size+1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the partial first line
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		return nil, nil
+	}
+
+	return data[i+1:], nil
+}
+
+// replicateLog stores the tail of the log of a finished task in etcd, so it outlives this node.
+// At most size bytes are stored, nothing if size is 0.
+func replicateLog(ctx context.Context, client clientv3.KV, id *api.TaskID, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	data, err := logTail(getLog(id), size)
+	if err != nil {
+		return fmt.Errorf("error reading task log: %s", err)
+	}
+
+	if _, err := client.Put(ctx, logKey(id), string(data)); err != nil {
+		return fmt.Errorf("error storing task log replica: %s", err)
+	}
+
+	return nil
+}
+
+// sendLogReplica sends the entries req asks for of the log replica of a finished task to stream, followed by its status
+func sendLogReplica(ctx context.Context, client clientv3.KV, req *api.LogsRequest, status *api.TaskStatus, stream api.TaskService_LogsServer) error {
+	id := req.Id
+
+	resp, err := client.Get(ctx, logKey(id))
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("task %s has no log replica", id.Uuid)
+	}
+
+	logs := &api.Log{Status: status}
+
+	scanner := bufio.NewScanner(bytes.NewReader(resp.Kvs[0].Value))
+	scanner.Buffer(nil, maxLogReplicaSize+1)
+	for scanner.Scan() {
+		// The scanner reuses its buffer
+		entry := parseLogEntry(append([]byte(nil), scanner.Bytes()...))
+
+		if matchesLogsRequest(entry, req) {
+			logs.Entries = append(logs.Entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if tail := int(req.TailLines); tail != 0 && len(logs.Entries) > tail {
+		logs.Entries = logs.Entries[len(logs.Entries)-tail:]
+	}
+
+	return stream.Send(logs)
+}
+
+// waitStopped blocks until task stops running, or ctx is canceled.
+// Returns the status of the task, nil if it was deleted or ctx was canceled.
+func waitStopped(ctx context.Context, client KVWatcher, task *Task) *api.TaskStatus {
+	for ctx.Err() == nil {
+		for taskEvent := range task.watch(ctx, client) {
+			switch taskEvent.(type) {
+			case TaskUpdate:
+				updated := taskEvent.(TaskUpdate).task
+				if updated.Status.GetRunning() == nil {
+					return updated.Status
+				}
+				task = updated
+
+			case TaskDelete:
+				return nil
+			}
+
+			// Errors watching the task are resumed, or end the watch
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// The revisions we were watching from have been compacted, check the task hasn't stopped in the meantime
+		resp, err := client.Get(ctx, task.key)
+		if err != nil {
+			sleep(ctx, minBackoff)
+			continue
+		}
+
+		if len(resp.Kvs) != 1 {
+			return nil
+		}
+
+		updated, err := parseTask(resp.Kvs[0])
+		if err != nil {
+			sleep(ctx, minBackoff)
+			continue
+		}
+
+		if updated.Status.GetRunning() == nil {
+			return updated.Status
+		}
+		task = updated
+	}
+
+	return nil
+}
+
+// proxyLogs forwards the logs of a task from node to stream.
+// Returns true if any were forwarded, even if an error occured.
+func proxyLogs(node *api.NodeID, req *api.LogsRequest, stream api.TaskService_LogsServer) (bool, error) {
+	client, conn, err := nodeClient(node)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	logs, err := client.Logs(stream.Context(), req)
+	if err != nil {
+		return false, err
+	}
+
+	forwarded := false
+
+	for {
+		log, err := logs.Recv()
+		if err == io.EOF {
+			return forwarded, nil
+		}
+		if err != nil {
+			return forwarded, err
+		}
+
+		if err := stream.Send(log); err != nil {
+			return forwarded, err
+		}
+		forwarded = true
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// TestLogTail tests only whole lines are kept of logs longer than the tail
+func TestLogTail(t *testing.T) {
+	f, err := ioutil.TempFile("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("first\nsecond\nthird\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, c := range []struct {
+		size     int64
+		expected string
+	}{
+		{100, "first\nsecond\nthird\n"},
+		{19, "first\nsecond\nthird\n"},
+		{13, "second\nthird\n"},
+		{10, "third\n"},
+		{6, "third\n"},
+		{5, ""},
+	} {
+		tail, err := logTail(f.Name(), c.size)
+		if err != nil {
+			t.Fatalf("Unexpected error reading tail of %d bytes: %v", c.size, err)
+		}
+
+		if string(tail) != c.expected {
+			t.Errorf("Expected tail of %d bytes to be %q, got %q", c.size, c.expected, tail)
+		}
+	}
+}
+
+// TestTaskLog tests the output of a task is split into entries by line and stream
+func TestTaskLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	taskLog, err := createTaskLog(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("a", maxLogLineSize+1)
+
+	// Split before the multi byte character that doesn't fit
+	wide := strings.Repeat("a", maxLogLineSize-1) + "é"
+
+	for _, w := range []struct {
+		stream *logStream
+		data   string
+	}{
+		{taskLog.stdout, "fir"},
+		{taskLog.stderr, "error\n"},
+		{taskLog.stdout, "st\nsecond\n" + long + "\n"},
+		{taskLog.stdout, wide + "\n"},
+		{taskLog.stdout, "\xff\xfe\n"},
+		{taskLog.stdout, "partial"},
+	} {
+		if _, err := w.stream.Write([]byte(w.data)); err != nil {
+			t.Fatalf("Unexpected error writing log: %v", err)
+		}
+	}
+
+	if err := taskLog.close(); err != nil {
+		t.Fatalf("Unexpected error closing log: %v", err)
+	}
+
+	expected := []*api.LogEntry{
+		{Stream: api.LogEntry_STDERR, Line: []byte("error")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("first")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("second")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte(long[:maxLogLineSize])},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("a")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte(wide[:maxLogLineSize-1])},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("é")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("\xff\xfe")},
+		{Stream: api.LogEntry_STDOUT, Line: []byte("partial")},
+	}
+
+	file, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 2*maxLogLineSize)
+
+	var entries []*api.LogEntry
+	for scanner.Scan() {
+		entries = append(entries, parseLogEntry(append([]byte(nil), scanner.Bytes()...)))
+	}
+
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(entries))
+	}
+
+	for i, entry := range entries {
+		if entry.Stream != expected[i].Stream || !bytes.Equal(entry.Line, expected[i].Line) || entry.Offset != uint64(i) || entry.TimeNanos == 0 {
+			t.Errorf("Expected entry %d to be %v, got %v", i, expected[i], entry)
+		}
+	}
+}
+
+// TestLogStart tests reading a log file can start at the entries a LogsRequest asks for
+func TestLogStart(t *testing.T) {
+	f, err := ioutil.TempFile("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	taskLog, err := createTaskLog(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := fmt.Fprintf(taskLog.stdout, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := taskLog.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		req      *api.LogsRequest
+		expected uint64
+	}{
+		{&api.LogsRequest{}, 0},
+		{&api.LogsRequest{TailLines: 10}, 90},
+		{&api.LogsRequest{TailLines: 1000}, 0},
+		{&api.LogsRequest{SinceOffset: 42}, 42},
+		{&api.LogsRequest{SinceOffset: 42, TailLines: 10}, 90},
+		{&api.LogsRequest{SinceOffset: 95, TailLines: 10}, 95},
+		{&api.LogsRequest{SinceOffset: 100}, 100},
+	} {
+		start, err := logStart(f.Name(), c.req)
+		if err != nil {
+			t.Fatalf("Unexpected error finding start of %v: %v", c.req, err)
+		}
+
+		file, err := os.Open(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first entry read is the one expected, or there are none
+		scanner := bufio.NewScanner(file)
+		if !scanner.Scan() {
+			if c.expected != 100 {
+				t.Errorf("Expected %v to start at entry %d, got no entries", c.req, c.expected)
+			}
+		} else if entry := parseLogEntry(scanner.Bytes()); entry.Offset != c.expected {
+			t.Errorf("Expected %v to start at entry %d, got %v", c.req, c.expected, entry)
+		}
+
+		file.Close()
+	}
+}
+
+// TestParseLegacyLogEntry tests lines of log files written before entries were stored as JSON are stdout entries
+func TestParseLegacyLogEntry(t *testing.T) {
+	for _, line := range []string{"plain text", "{}", `{"line": "not an entry"}`, ""} {
+		entry := parseLogEntry([]byte(line))
+		if entry.Stream != api.LogEntry_STDOUT || string(entry.Line) != line {
+			t.Errorf("Expected %q to be parsed as a stdout entry, got %v", line, entry)
+		}
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"path/filepath"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/docker/go-units"
 	"github.com/jessevdk/go-flags"
 
 	"github.com/arthurfabre/scheduler/api"
@@ -17,6 +19,9 @@ const (
 	// Subdirectories of our data dir
 	etcdDir      = "etcd"
 	containerDir = "container"
+	layerDir     = "layer"
+	imageDir     = "image"
+	inputDir     = "input"
 
 	// timeout for starting etcd and the client
 	// Needs to be fairly long for static bootstrap to complete
@@ -41,7 +46,33 @@ var opts struct {
 
 	NewCluster bool `short:"n" long:"new-cluster" description:"Start a new cluster (instead of joining an existing one)"`
 
-	RootFs string `short:"r" long:"root-fs" description:"RootFS used to run tasks in"`
+	RootFs string `short:"r" long:"root-fs" description:"RootFS used to run tasks that don't have an image in"`
+
+	ResyncInterval time.Duration `long:"resync-interval" default:"1m" description:"Interval at which the full queue is checked for tasks to run"`
+
+	Cpus float64 `long:"cpus" description:"Number of CPUs that can be allocated to tasks (defaults to all of them)"`
+
+	Memory string `long:"memory" description:"Memory that can be allocated to tasks, eg 4g (defaults to all of it)"`
+
+	MaxTasks uint64 `long:"max-tasks" description:"Maximum number of tasks to run at once (defaults to unlimited)"`
+
+	GCInterval time.Duration `long:"gc-interval" default:"10m" description:"Interval at which finished tasks are garbage collected"`
+
+	RetainComplete time.Duration `long:"retain-complete" default:"168h" description:"How long complete tasks and their logs are kept for, 0 to keep them forever"`
+
+	RetainCanceled time.Duration `long:"retain-canceled" default:"24h" description:"How long canceled tasks and their logs are kept for, 0 to keep them forever"`
+
+	RetainFailed time.Duration `long:"retain-failed" default:"168h" description:"How long failed tasks and their logs are kept for, 0 to keep them forever"`
+
+	RetainTimedOut time.Duration `long:"retain-timed-out" default:"168h" description:"How long timed out tasks and their logs are kept for, 0 to keep them forever"`
+
+	LogReplicaSize string `long:"log-replica-size" default:"16k" description:"How much of the end of the logs of finished tasks is replicated in etcd, so they outlive this node, at most 1m, 0 to disable. Counts towards the etcd quota"`
+
+	StealDelay time.Duration `long:"steal-delay" default:"500ms" description:"Delay before stealing a queued task when fully loaded, proportional to load"`
+
+	StealJitter time.Duration `long:"steal-jitter" default:"50ms" description:"Maximum random delay added before stealing a queued task"`
+
+	StealLoad string `long:"steal-load" default:"tasks" choice:"tasks" choice:"loadavg" description:"Load metric the steal delay is proportional to: running tasks or load average, per CPU"`
 }
 
 // getLog returns the log file location for a given TaskID
@@ -49,6 +80,44 @@ func getLog(id *api.TaskID) string {
 	return filepath.Join(opts.DataDir, id.Uuid)
 }
 
+// getLayer returns the copy-on-write rootfs layer location for a given TaskID
+func getLayer(id *api.TaskID) string {
+	return filepath.Join(opts.DataDir, layerDir, id.Uuid)
+}
+
+// getInputs returns the input files location for a given TaskID
+func getInputs(id *api.TaskID) string {
+	return filepath.Join(opts.DataDir, inputDir, id.Uuid)
+}
+
+// nodeCapacity creates the capacity of this node from the parsed opts
+func nodeCapacity() (*capacity, error) {
+	if opts.Cpus < 0 {
+		return nil, fmt.Errorf("invalid CPUs %v", opts.Cpus)
+	}
+
+	var memory int64
+	if opts.Memory != "" {
+		var err error
+		memory, err = units.RAMInBytes(opts.Memory)
+		if err != nil || memory < 0 {
+			return nil, fmt.Errorf("invalid memory %s", opts.Memory)
+		}
+	}
+
+	return newCapacity(uint64(opts.Cpus*1000), uint64(memory), opts.MaxTasks)
+}
+
+// logReplicaSize parses the log replica size from the parsed opts
+func logReplicaSize() (int64, error) {
+	size, err := units.RAMInBytes(opts.LogReplicaSize)
+	if err != nil || size < 0 || size > maxLogReplicaSize {
+		return 0, fmt.Errorf("invalid log replica size %s", opts.LogReplicaSize)
+	}
+
+	return size, nil
+}
+
 // start runs a function in a goroutine, writing any errors to e. Non-blocking.
 func start(f func() error, e chan<- error) {
 	go func() {
@@ -93,8 +162,38 @@ func run() error {
 		return err
 	}
 
+	if opts.ResyncInterval <= 0 {
+		return fmt.Errorf("invalid resync interval %v", opts.ResyncInterval)
+	}
+
+	if opts.GCInterval <= 0 {
+		return fmt.Errorf("invalid gc interval %v", opts.GCInterval)
+	}
+
 	id := nodeID(opts.Args.IP, opts.ApiPort)
 
+	runnerCapacity, err := nodeCapacity()
+	if err != nil {
+		return err
+	}
+
+	policy, err := newStealPolicy(opts.StealDelay, opts.StealJitter, opts.StealLoad, runnerCapacity)
+	if err != nil {
+		return err
+	}
+
+	images, err := newImageStore(filepath.Join(opts.DataDir, imageDir))
+	if err != nil {
+		return err
+	}
+
+	replicaSize, err := logReplicaSize()
+	if err != nil {
+		return err
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 
 	errors := make(chan error)
@@ -108,12 +207,54 @@ func run() error {
 		return fmt.Errorf("error connecting to local etcd: %s", err)
 	}
 
-	taskServer := taskServiceServer{cli, id}
+	runnerHealth := newHealth()
+	runnerCounters := &stealCounters{}
+	runnerContainers := newContainers()
+
+	taskServer := taskServiceServer{
+		client:     cli,
+		id:         id,
+		health:     runnerHealth,
+		counters:   runnerCounters,
+		images:     images,
+		containers: runnerContainers,
+	}
 	start(func() error {
 		return taskServer.Run(opts.Args.IP, opts.ApiPort)
 	}, errors)
 
-	runner := Runner{cli, id}
+	node := Node{cli, id}
+	start(func() error {
+		return node.Run(rootCtx)
+	}, errors)
+
+	collector := Collector{
+		client:   cli,
+		id:       id,
+		interval: opts.GCInterval,
+		retention: retention{
+			complete: opts.RetainComplete,
+			canceled: opts.RetainCanceled,
+			failed:   opts.RetainFailed,
+			timedOut: opts.RetainTimedOut,
+		},
+	}
+	start(func() error {
+		return collector.Run(rootCtx, opts.DataDir, filepath.Join(opts.DataDir, layerDir), filepath.Join(opts.DataDir, inputDir))
+	}, errors)
+
+	runner := Runner{
+		client:         cli,
+		id:             id,
+		resyncInterval: opts.ResyncInterval,
+		health:         runnerHealth,
+		capacity:       runnerCapacity,
+		policy:         policy,
+		counters:       runnerCounters,
+		images:         images,
+		containers:     runnerContainers,
+		logReplicaSize: replicaSize,
+	}
 	start(func() error {
 		return runner.Run(rootCtx, filepath.Join(opts.DataDir, containerDir), opts.RootFs)
 	}, errors)
@@ -1,37 +1,316 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/satori/go.uuid"
 
 	"github.com/arthurfabre/scheduler/api"
 )
 
+// Prefix under which live nodes publish their NodeID
+// See README/#ETCD Key Schema
+const nodePrefix = "node/"
+
+// nodeTTL is the TTL, in seconds, of the lease node keys are bound to.
+// A node is considered dead nodeTTL seconds after it stops refreshing its lease.
+const nodeTTL = 10
+
 // nodeID returns a NodeID with new random UUID
 func nodeID(ip string, apiPort uint16) *api.NodeID {
 	return &api.NodeID{uuid.NewV4().String(), ip, int32(apiPort)}
 }
 
-// TODO
-/*func registerNode(client *clientv3.Client, id *api.NodeID) (*api.NodeID, error) {
-	id := nodeID
+// nodeKey returns the etcd key for a NodeID
+func nodeKey(id *api.NodeID) string {
+	return nodePrefix + id.Uuid
+}
 
-	resp, err := client.Grant(context.Background(), 30)
+// isAlive returns true if the node with id is alive, ie its lease hasn't expired
+func isAlive(ctx context.Context, client clientv3.KV, id *api.NodeID) (bool, error) {
+	resp, err := client.Get(ctx, nodeKey(id), clientv3.WithCountOnly())
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
 
-	_, err = cli.Put(context.TODO(), "foo", "bar", clientv3.WithLease(resp.ID))
+	return resp.Count != 0, nil
+}
+
+// parseNodeID converts a node key to a NodeID. Only the UUID is set.
+func parseNodeID(key string) *api.NodeID {
+	return &api.NodeID{Uuid: strings.TrimPrefix(key, nodePrefix)}
+}
+
+// Node handles publishing our liveness, and requeuing the tasks of nodes that have died.
+type Node struct {
+	client *clientv3.Client
+	id     *api.NodeID
+}
+
+// register publishes our NodeID bound to a lease, and returns a channel that is closed when the lease is lost.
+func (n *Node) register(ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	lease, err := n.client.Grant(ctx, nodeTTL)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error granting node lease: %s", err)
 	}
 
-	// the key 'foo' will be kept forever
-	ch, kaerr := cli.KeepAlive(context.TODO(), resp.ID)
-	if kaerr != nil {
-		log.Fatal(kaerr)
+	data, err := proto.Marshal(n.id)
+	if err != nil {
+		return nil, err
 	}
+
+	_, err = n.client.Put(ctx, nodeKey(n.id), string(data), clientv3.WithLease(lease.ID))
+	if err != nil {
+		return nil, fmt.Errorf("error publishing node: %s", err)
+	}
+
+	keepAlive, err := n.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error keeping node lease alive: %s", err)
+	}
+
+	return keepAlive, nil
 }
 
-func watchDeadNodes(client *clientv3.Client, ctx context.Context) <-chan *api.NodeID {
+// watchDeadNodes returns a channel of NodeIDs of nodes that have died: orphaned nodes first, then nodes whose key is deleted.
+// Errors are logged and the watch resumed with backoff. Orphaned nodes are listed again if the revisions it needs are compacted.
+func watchDeadNodes(ctx context.Context, client KVWatcher) <-chan *api.NodeID {
+	out := make(chan *api.NodeID)
+
+	go func() {
+		defer close(out)
+
+		// Revision dead nodes have been sent up to, 0 until orphaned nodes have been listed
+		var rev int64
+		backoff := minBackoff
+
+		err := sendOrphanedNodes(ctx, client, out, &rev)
+
+		for ctx.Err() == nil {
+			if err == nil {
+				err = watchDeadNodesFrom(ctx, client, out, &rev)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+
+			log.Println("Error watching for dead nodes:", err)
 
-}*/
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+
+			if rev == 0 || err == rpctypes.ErrCompacted {
+				// Nodes that died in the compacted revisions are still orphaned
+				err = sendOrphanedNodes(ctx, client, out, &rev)
+			} else {
+				// Ensure etcd is reachable, and the revision we need hasn't been compacted
+				_, err = client.Get(ctx, nodePrefix, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithCountOnly())
+			}
+
+			if err == nil {
+				backoff = minBackoff
+				log.Println("Resumed watching for dead nodes")
+			}
+		}
+	}()
+
+	return out
+}
+
+// watchDeadNodesFrom sends the NodeIDs of nodes whose key is deleted after revision rev to out, updating rev as events are seen.
+// Returns the error that interrupted the watch.
+func watchDeadNodesFrom(ctx context.Context, client clientv3.Watcher, out chan<- *api.NodeID, rev *int64) error {
+	// Ensure we don't leak the watch if we stop early
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+
+	for resp := range client.Watch(watchCtx, nodePrefix, clientv3.WithPrefix(), clientv3.WithFilterPut(), clientv3.WithRev(*rev+1)) {
+		if resp.Err() != nil {
+			return resp.Err()
+		}
+
+		for _, ev := range resp.Events {
+			if ev.Type != mvccpb.DELETE {
+				continue
+			}
+
+			if !sendNodeID(ctx, out, parseNodeID(string(ev.Kv.Key))) {
+				return ctx.Err()
+			}
+
+			*rev = ev.Kv.ModRevision
+		}
+	}
+
+	return fmt.Errorf("watch closed")
+}
+
+// sendOrphanedNodes sends the NodeIDs of orphaned nodes to out, and sets rev to the revision they were listed at
+func sendOrphanedNodes(ctx context.Context, client clientv3.KV, out chan<- *api.NodeID, rev *int64) error {
+	orphaned, listRev, err := listOrphanedNodes(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error listing dead nodes: %s", err)
+	}
+
+	for _, node := range orphaned {
+		if !sendNodeID(ctx, out, node) {
+			return ctx.Err()
+		}
+	}
+
+	*rev = listRev
+
+	return nil
+}
+
+// sendNodeID writes id to out, unless ctx is canceled first.
+// Returns false IFF ctx was canceled.
+func sendNodeID(ctx context.Context, out chan<- *api.NodeID, id *api.NodeID) bool {
+	select {
+	case out <- id:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// listOrphanedNodes returns the NodeIDs of nodes that have running tasks, but are no longer alive, and the revision they were listed at.
+// This catches nodes that died while no one was watching (eg whole cluster restart).
+func listOrphanedNodes(ctx context.Context, client clientv3.KV) ([]*api.NodeID, int64, error) {
+	running, err := client.Get(ctx, allRunningPrefix(), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Nodes dying after the running tasks are listed are either not alive anymore, or seen by watching from its revision
+	alive, err := client.Get(ctx, nodePrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	isAlive := make(map[string]bool)
+	for _, kv := range alive.Kvs {
+		isAlive[parseNodeID(string(kv.Key)).Uuid] = true
+	}
+
+	var orphaned []*api.NodeID
+	seen := make(map[string]bool)
+
+	for _, kv := range running.Kvs {
+		id := runningNodeID(string(kv.Key))
+
+		if isAlive[id.Uuid] || seen[id.Uuid] {
+			continue
+		}
+
+		seen[id.Uuid] = true
+		orphaned = append(orphaned, id)
+	}
+
+	return orphaned, running.Header.Revision, nil
+}
+
+// requeueNodeTasks requeues (or fails, if they have run out of attempts) all the tasks that were running on a dead node.
+// Every node races to do this, tasks already handled by someone else are skipped.
+func (n *Node) requeueNodeTasks(ctx context.Context, deadNode *api.NodeID) error {
+	tasks, err := listNodeTasks(ctx, n.client, deadNode)
+	if err != nil {
+		return err
+	}
+
+	for _, taskEvent := range tasks {
+		switch taskEvent.(type) {
+		case TaskUpdate:
+			task := taskEvent.(TaskUpdate).task
+
+			err := task.retry(ctx, n.client, deadNode, fmt.Errorf("node %s died while running task", deadNode.Uuid))
+			switch err {
+			case nil:
+				log.Println("Requeued task", task.Id.Uuid, "of dead node", deadNode.Uuid)
+			case ConcurrentTaskModErr:
+				// Expected, someone else requeued the task
+			default:
+				log.Println("Error requeuing task of dead node:", err)
+			}
+
+		case TaskError:
+			log.Println("Error listing tasks of dead node:", taskEvent.(TaskError).err)
+		}
+	}
+
+	return nil
+}
+
+// Run publishes our liveness, and requeues the tasks of dead nodes. Blocking.
+// If we lose our lease, other nodes requeue our tasks, and we register again.
+func (n *Node) Run(ctx context.Context) error {
+	deadNodes := watchDeadNodes(ctx, n.client)
+
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		// Stops refreshing the lease if we register again
+		leaseCtx, leaseCancel := context.WithCancel(ctx)
+
+		keepAlive, err := n.register(leaseCtx)
+		if err != nil {
+			leaseCancel()
+			log.Println(err)
+
+			sleep(ctx, backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		backoff = minBackoff
+
+		err = n.requeueDeadNodes(ctx, keepAlive, deadNodes)
+		leaseCancel()
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Println(err, "registering again")
+	}
+
+	return nil
+}
+
+// requeueDeadNodes requeues the tasks of deadNodes, until keepAlive is closed or we're declared dead. Returns why it stopped.
+func (n *Node) requeueDeadNodes(ctx context.Context, keepAlive <-chan *clientv3.LeaseKeepAliveResponse, deadNodes <-chan *api.NodeID) error {
+	for {
+		select {
+		case _, ok := <-keepAlive:
+			if !ok {
+				// Our lease has expired, other nodes will requeue our tasks
+				return fmt.Errorf("node lease lost")
+			}
+
+		case deadNode, ok := <-deadNodes:
+			if !ok {
+				return ctx.Err()
+			}
+
+			// We might be the one that was declared dead
+			if deadNode.Uuid == n.id.Uuid {
+				return fmt.Errorf("node declared dead by cluster")
+			}
+
+			log.Println("Node", deadNode.Uuid, "died, requeuing its tasks")
+
+			if err := n.requeueNodeTasks(ctx, deadNode); err != nil {
+				log.Println("Error requeuing tasks of dead node:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Subdirectories of a task's layer
+const (
+	// upperDir holds the changes the task made to the rootfs
+	upperDir = "upper"
+
+	// workDir is used internally by overlayfs
+	workDir = "work"
+
+	// mergedDir is where the rootfs of the task is mounted
+	mergedDir = "merged"
+)
+
+// mountLayer mounts a copy-on-write overlay of the read-only lowerDirs (from the top most) in layer.
+// Any previous layer is discarded. Returns the path of the mounted rootfs.
+func mountLayer(lowerDirs []string, layer string) (string, error) {
+	// A previous attempt at running the task might have left its layer behind
+	if err := removeLayer(layer); err != nil {
+		return "", err
+	}
+
+	for _, dir := range []string{upperDir, workDir, mergedDir} {
+		if err := os.MkdirAll(filepath.Join(layer, dir), 0700); err != nil {
+			return "", fmt.Errorf("error creating layer directory: %s", err)
+		}
+	}
+
+	// Root in the container needs to reach the layer, and owns it
+	if err := allowTraverse(filepath.Dir(layer)); err != nil {
+		return "", err
+	}
+
+	root, err := hostID(0)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range []string{layer, filepath.Join(layer, upperDir), filepath.Join(layer, workDir)} {
+		if err := os.Lchown(dir, root, root); err != nil {
+			return "", fmt.Errorf("error changing layer directory owner: %s", err)
+		}
+	}
+
+	// The rootfs takes the mode of the upper directory, other users in the container need to traverse it
+	if err := os.Chmod(filepath.Join(layer, upperDir), 0755); err != nil {
+		return "", fmt.Errorf("error changing layer directory mode: %s", err)
+	}
+
+	merged := filepath.Join(layer, mergedDir)
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), filepath.Join(layer, upperDir), filepath.Join(layer, workDir))
+
+	if err := unix.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return "", fmt.Errorf("error mounting overlay: %s", err)
+	}
+
+	return merged, nil
+}
+
+// allowTraverse lets everyone search dir and all its parents, so users in containers can reach the layers in it.
+func allowTraverse(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("error getting layer directory path: %s", err)
+	}
+
+	for {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("error getting layer directory mode: %s", err)
+		}
+
+		if mode := info.Mode().Perm(); mode&0111 != 0111 {
+			if err := os.Chmod(dir, mode|0111); err != nil {
+				return fmt.Errorf("error changing layer directory mode: %s", err)
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// unmountLayer unmounts the rootfs of layer. The changes made to it are kept in its upper directory.
+func unmountLayer(layer string) error {
+	if err := unix.Unmount(filepath.Join(layer, mergedDir), unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("error unmounting overlay: %s", err)
+	}
+
+	return nil
+}
+
+// removeLayer unmounts and deletes layer, if it exists.
+func removeLayer(layer string) error {
+	if err := unmountLayer(layer); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(layer); err != nil {
+		return fmt.Errorf("error removing layer: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestMountLayerOwner tests the rootfs of a layer is owned by root in containers, and can be reached by it
+func TestMountLayerOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Mounting overlays requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lower := filepath.Join(dir, "lower")
+	if err := os.Mkdir(lower, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(lower, "hello"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := filepath.Join(dir, "layer", "task")
+	merged, err := mountLayer([]string{lower}, layer)
+	if err != nil {
+		t.Fatalf("Unexpected error mounting layer: %v", err)
+	}
+	defer removeLayer(layer)
+
+	info, err := os.Stat(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected rootfs mode 0755, got %v", info.Mode().Perm())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != idMapHostID || stat.Gid != idMapHostID {
+		t.Errorf("Expected rootfs to be owned by the mapped root, got %d:%d", stat.Uid, stat.Gid)
+	}
+
+	if _, err := os.Stat(filepath.Join(merged, "hello")); err != nil {
+		t.Errorf("Expected lower files in rootfs, got %v", err)
+	}
+
+	// Every parent of the layer can be traversed
+	for _, parent := range []string{dir, filepath.Join(dir, "layer")} {
+		info, err := os.Stat(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0111 != 0111 {
+			t.Errorf("Expected %s to be traversable, got %v", parent, info.Mode().Perm())
+		}
+	}
+
+	info, err = os.Stat(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != idMapHostID {
+		t.Errorf("Expected layer to be owned by the mapped root, got %d", stat.Uid)
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	_ "github.com/opencontainers/runc/libcontainer/nsenter"
 	"golang.org/x/sys/unix"
@@ -18,8 +22,23 @@ import (
 	"github.com/arthurfabre/scheduler/api"
 )
 
-// taskAttempts is the maximum number of times we attempt to run a given task
-const taskAttempts = 3
+// cpuPeriod is the CFS period, in microseconds, CPU quotas of tasks are enforced over
+const cpuPeriod = 100000
+
+// Container uids and gids from 0 to idMapSize are mapped to host ids from idMapHostID
+const (
+	idMapHostID = 1000
+	idMapSize   = 65536
+)
+
+// hostID returns the host uid / gid a container uid / gid is mapped to
+func hostID(id int) (int, error) {
+	if id < 0 || id >= idMapSize {
+		return 0, fmt.Errorf("id %d isn't mapped in containers", id)
+	}
+
+	return id + idMapHostID, nil
+}
 
 // Allow us to use ourselves as the container init
 // nicked from https://github.com/opencontainers/runc/tree/master/libcontainer#using-libcontainer
@@ -140,15 +159,15 @@ func config(rootFs string, cgroupName string) *configs.Config {
 		UidMappings: []configs.IDMap{
 			{
 				ContainerID: 0,
-				HostID:      1000,
-				Size:        65536,
+				HostID:      idMapHostID,
+				Size:        idMapSize,
 			},
 		},
 		GidMappings: []configs.IDMap{
 			{
 				ContainerID: 0,
-				HostID:      1000,
-				Size:        65536,
+				HostID:      idMapHostID,
+				Size:        idMapSize,
 			},
 		},
 		Networks: []*configs.Network{
@@ -168,40 +187,258 @@ func config(rootFs string, cgroupName string) *configs.Config {
 	}
 }
 
-// process creates a libcontainer Process from a Task
-func process(task *Task) (*libcontainer.Process, error) {
-	log, err := os.Create(getLog(task.Id))
+// limitResources applies the limits of a TaskRequest to a container's cgroup resources.
+// limits may be nil, in which case nothing is limited.
+func limitResources(resources *configs.Resources, limits *api.Resources) {
+	if limits == nil {
+		return
+	}
+
+	resources.CpuShares = limits.CpuShares
+
+	if limits.CpuMillis > 0 {
+		resources.CpuPeriod = cpuPeriod
+		resources.CpuQuota = int64(limits.CpuMillis * cpuPeriod / 1000)
+	}
+
+	if limits.MemoryBytes > 0 {
+		resources.Memory = int64(limits.MemoryBytes)
+		// Don't let the task use swap to get around its limit
+		resources.MemorySwap = int64(limits.MemoryBytes)
+	}
+
+	if limits.Pids > 0 {
+		resources.PidsLimit = int64(limits.Pids)
+	}
+}
+
+// resourceUsage reads the resources used by the processes of container from its cgroup.
+// The cgroup must not have been destroyed yet. Only wall is set if the cgroup can't be read.
+func resourceUsage(container libcontainer.Container, wall time.Duration) *api.ResourceUsage {
+	usage := &api.ResourceUsage{WallMillis: int64(wall / time.Millisecond)}
+
+	stats, err := container.Stats()
+	if err != nil || stats.CgroupStats == nil {
+		log.Println("Error reading task resource usage:", err)
+		return usage
+	}
+
+	cgroup := stats.CgroupStats
+
+	usage.CpuNanos = cgroup.CpuStats.CpuUsage.TotalUsage
+	usage.MaxMemoryBytes = cgroup.MemoryStats.Usage.MaxUsage
+	usage.IoReadBytes, usage.IoWriteBytes = ioBytes(cgroup)
+
+	return usage
+}
+
+// ioBytes returns the bytes read from and written to block devices by the processes of a cgroup
+func ioBytes(cgroup *cgroups.Stats) (uint64, uint64) {
+	var read, written uint64
+
+	for _, entry := range cgroup.BlkioStats.IoServiceBytesRecursive {
+		switch entry.Op {
+		case "Read":
+			read += entry.Value
+		case "Write":
+			written += entry.Value
+		}
+	}
+
+	return read, written
+}
+
+// taskStats reads the current resource usage of the processes of container from its cgroup
+func taskStats(container libcontainer.Container) (*api.TaskStats, error) {
+	stats, err := container.Stats()
 	if err != nil {
 		return nil, err
 	}
+	if stats.CgroupStats == nil {
+		return nil, fmt.Errorf("no cgroup stats")
+	}
+
+	cgroup := stats.CgroupStats
+
+	// Unlimited cgroups report the maximum the kernel supports, use the limits we configured instead
+	limits := container.Config().Cgroups.Resources
+
+	taskStats := &api.TaskStats{
+		Epoch:            time.Now().UnixNano(),
+		CpuNanos:         cgroup.CpuStats.CpuUsage.TotalUsage,
+		MemoryBytes:      cgroup.MemoryStats.Usage.Usage,
+		MaxMemoryBytes:   cgroup.MemoryStats.Usage.MaxUsage,
+		MemoryLimitBytes: uint64(limits.Memory),
+		Pids:             cgroup.PidsStats.Current,
+		PidsLimit:        uint64(limits.PidsLimit),
+	}
+	taskStats.IoReadBytes, taskStats.IoWriteBytes = ioBytes(cgroup)
+
+	return taskStats, nil
+}
+
+// process creates a libcontainer Process from a Task, whose output is written to taskLog
+func process(task *Task, taskLog *taskLog) *libcontainer.Process {
+	user := task.Request.User
+	if user == "" {
+		user = "root"
+	}
 
 	return &libcontainer.Process{
 		Args:   append([]string{task.Request.Command}, task.Request.Args...),
-		Env:    []string{"PATH=/bin"},
-		User:   "root",
+		Env:    env(task.Request.Env),
+		User:   user,
+		Cwd:    task.Request.WorkingDir,
 		Stdin:  nil,
-		Stdout: log,
-		Stderr: log,
-	}, nil
+		Stdout: taskLog.stdout,
+		Stderr: taskLog.stderr,
+	}
+}
+
+// env returns the environment of a task process, adding a default PATH if it isn't set
+func env(taskEnv []string) []string {
+	for _, v := range taskEnv {
+		if strings.HasPrefix(v, "PATH=") {
+			return taskEnv
+		}
+	}
+
+	return append([]string{"PATH=/bin"}, taskEnv...)
+}
+
+// health tracks whether a Runner is able to watch for queued tasks, ie steal work.
+type health struct {
+	sync.Mutex
+
+	// err is the last error encountered, nil if healthy
+	err error
+
+	// since is when the health last changed
+	since time.Time
+}
+
+// newHealth returns an unhealthy health, as we can't steal work until we've started watching
+func newHealth() *health {
+	return &health{err: fmt.Errorf("not watching for queued tasks yet"), since: time.Now()}
+}
+
+// set records the result of the last attempt to watch for queued tasks. err is nil if it succeeded.
+func (h *health) set(err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if (h.err == nil) != (err == nil) {
+		h.since = time.Now()
+	}
+
+	h.err = err
+}
+
+// get returns since when the health has been the same, and the last error encountered (nil if healthy).
+func (h *health) get() (time.Time, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.since, h.err
+}
+
+// containers tracks the containers of the tasks running on this node, by task UUID.
+type containers struct {
+	sync.Mutex
+
+	byID map[string]libcontainer.Container
+}
+
+// newContainers returns an empty containers
+func newContainers() *containers {
+	return &containers{byID: make(map[string]libcontainer.Container)}
+}
+
+// add tracks the container of the task with id
+func (c *containers) add(id *api.TaskID, container libcontainer.Container) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.byID[id.Uuid] = container
+}
+
+// remove stops tracking the container of the task with id
+func (c *containers) remove(id *api.TaskID) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.byID, id.Uuid)
+}
+
+// get returns the container of the task with id, and false if it isn't running
+func (c *containers) get(id *api.TaskID) (libcontainer.Container, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	container, ok := c.byID[id.Uuid]
+	return container, ok
 }
 
 type Runner struct {
 	client *clientv3.Client
 	id     *api.NodeID
+
+	// resyncInterval is how often the queue is listed in full, to catch tasks the watch might have missed
+	resyncInterval time.Duration
+
+	// health of our watch for queued tasks, shared with the API
+	health *health
+
+	// capacity of this node, tasks are only stolen if they fit in it
+	capacity *capacity
+
+	// policy decides how long to wait before stealing a task
+	policy *stealPolicy
+
+	// counters of steal outcomes, shared with the API
+	counters *stealCounters
+
+	// wake is signaled when a task waiting out its retry backoff can be run
+	wake chan struct{}
+
+	// delaying are the tasks we're waiting to steal
+	delaying *taskSet
+
+	// backingOff are the retried tasks we're waiting to wake up for, once their backoff is over
+	backingOff *taskSet
+
+	// oversized are the queued tasks we've logged as never fitting on this node
+	oversized *taskSet
+
+	// deferred are the queued tasks we couldn't run yet, offered again when capacity is freed,
+	// a retried task's backoff is over, or an image is imported
+	deferred *deferredTasks
+
+	// images tasks can be run in
+	images *imageStore
+
+	// containers of running tasks, shared with the API
+	containers *containers
+
+	// logReplicaSize is how much of the end of the logs of finished tasks is replicated in etcd
+	logReplicaSize int64
 }
 
-// watchCancel watches a Task for cancellation, killing process when it is.
-// True is written to returned channel IFF the task is cancelled
-func (r *Runner) watchCancel(task *Task, process *libcontainer.Process, ctx context.Context) <-chan bool {
-	cancel := make(chan bool)
+// waitCanceled blocks until task is modified (ie canceled) or deleted, or ctx is canceled.
+// Returns true IFF the task was modified or deleted, and the modified Task if it could be retrieved.
+func (r *Runner) waitCanceled(ctx context.Context, task *Task) (bool, *Task) {
+	rev := task.modRevision
 
-	// Watch for the task to be canceled.
-	go func() {
-		defer close(cancel)
+	for ctx.Err() == nil {
+		// Stops the watch if we stop reading it early
+		watchCtx, watchCancel := context.WithCancel(ctx)
 
-		for taskEvent := range task.watch(ctx, r.client) {
+	watch:
+		for taskEvent := range watchTasks(watchCtx, r.client, task.key, rev) {
 			switch taskEvent.(type) {
 			case TaskUpdate:
+				watchCancel()
+
 				taskUpdate := taskEvent.(TaskUpdate)
 				switch taskUpdate.task.Status.Status.(type) {
 				case *api.TaskStatus_Canceled_:
@@ -209,133 +446,570 @@ func (r *Runner) watchCancel(task *Task, process *libcontainer.Process, ctx cont
 				default:
 					log.Println("WARN: Unepexcted modifiction of Task while running:", taskUpdate)
 				}
+				return true, taskUpdate.task
+
 			case TaskDelete:
+				watchCancel()
+
 				log.Println("WARN: Unexpected Task deletion while running")
+				return true, nil
+
 			case TaskError:
-				log.Println("WARN: Error watching Task for cancelation:", taskEvent.(TaskError).err)
+				taskError := taskEvent.(TaskError)
+				if taskError.id == nil {
+					// The watch will be resumed
+					log.Println("WARN: Error watching Task for cancelation:", taskError.err)
+					continue
+				}
+
+				// The Task might not have been modified, check below
+				log.Println("WARN: Error retrieving Task while running:", taskError.err)
+				break watch
 			}
+		}
+
+		watchCancel()
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// The revisions we were watching from have been compacted, or the modified Task couldn't be retrieved.
+		// Check the task hasn't changed in the meantime.
+		resp, err := r.client.Get(ctx, task.key)
+		if err != nil {
+			log.Println("WARN: Error retrieving Task for cancelation:", err)
+			sleep(ctx, minBackoff)
+			continue
+		}
 
-			process.Signal(os.Kill)
-			cancel <- true
+		if len(resp.Kvs) != 1 {
+			return true, nil
+		}
+
+		if resp.Kvs[0].ModRevision != task.modRevision {
+			updated, err := parseTask(resp.Kvs[0])
+			if err != nil {
+				log.Println("WARN: Error parsing Task while running:", err)
+				return true, nil
+			}
+			return true, updated
 		}
+
+		rev = resp.Header.Revision
+	}
+
+	return false, nil
+}
+
+// kill kills every process of container
+func kill(container libcontainer.Container) {
+	if err := container.Signal(unix.SIGKILL, true); err != nil {
+		log.Println("Error killing task:", err)
+	}
+}
+
+// stop sends task its stop signal, and waits for its grace period or for it to be forcefully canceled.
+// ctx should be canceled once the task has exited.
+func (r *Runner) stop(ctx context.Context, task *Task, container libcontainer.Container) {
+	if err := container.Signal(task.stopSignal(), false); err != nil {
+		log.Println("Error sending stop signal to task:", err)
+		return
+	}
+
+	graceCtx, graceCancel := context.WithTimeout(ctx, task.stopGrace())
+	defer graceCancel()
+
+	// The only modification expected is a forced cancelation
+	r.waitCanceled(graceCtx, task)
+}
+
+// watchCancel watches a Task for cancellation, stopping container when it is.
+// The task is sent its stop signal, and every process of container is killed if it hasn't exited by the end of its grace period.
+// True is written to returned channel IFF the task is cancelled. The channel is closed once ctx is canceled.
+func (r *Runner) watchCancel(task *Task, container libcontainer.Container, ctx context.Context) <-chan bool {
+	cancel := make(chan bool, 1)
+
+	// Watch for the task to be canceled.
+	go func() {
+		defer close(cancel)
+
+		canceled, updated := r.waitCanceled(ctx, task)
+		if !canceled {
+			return
+		}
+
+		cancel <- true
+
+		// Give the task a chance to exit cleanly, unless it wasn't canceled normally or is being forced to
+		if updated != nil && updated.Status.GetCanceled() != nil && !updated.Status.GetCanceled().Force {
+			r.stop(ctx, updated, container)
+		}
+
+		// The task exited by itself
+		if ctx.Err() != nil {
+			return
+		}
+
+		kill(container)
 	}()
 
 	return cancel
 }
 
+// watchTimeout kills every process of container once task has been running for longer than its timeout.
+// True is written to returned channel IFF the task timed out. The channel is closed once ctx is canceled.
+func (r *Runner) watchTimeout(task *Task, container libcontainer.Container, ctx context.Context) <-chan bool {
+	timedOut := make(chan bool, 1)
+
+	go func() {
+		defer close(timedOut)
+
+		if task.timeout() == 0 {
+			return
+		}
+
+		timer := time.NewTimer(task.timeout())
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			kill(container)
+			timedOut <- true
+		case <-ctx.Done():
+		}
+	}()
+
+	return timedOut
+}
+
 // run executes a Task in a container. Error indicates task was not able to be run.
-func (r *Runner) runTask(ctx context.Context, task *Task, factory libcontainer.Factory, cfg *configs.Config) error {
+func (r *Runner) runTask(ctx context.Context, task *Task, factory libcontainer.Factory, rootFs string) error {
+	lowerDirs := []string{rootFs}
+	if task.Request.Image != "" {
+		var err error
+		if lowerDirs, err = r.images.lowerDirs(task.Request.Image); err != nil {
+			return fmt.Errorf("error getting task image: %s", err)
+		}
+	}
+
+	// Every task gets its own copy-on-write layer, so it can't change the rootfs of other tasks
+	layer := getLayer(task.Id)
+	taskRootFs, err := mountLayer(lowerDirs, layer)
+	if err != nil {
+		return fmt.Errorf("error creating task layer: %s", err)
+	}
+	defer func() {
+		cleanup := removeLayer
+		if task.Request.KeepLayer {
+			cleanup = unmountLayer
+		}
+
+		if err := cleanup(layer); err != nil {
+			log.Println("Error cleaning up task layer:", err)
+		}
+	}()
+
+	if task.InputNode != nil {
+		if err := r.copyInputs(ctx, task, taskRootFs); err != nil {
+			return fmt.Errorf("error copying task input files: %s", err)
+		}
+	}
+
+	// Every task gets its own cgroup, so its resources can be limited independently
+	cfg := config(taskRootFs, task.Id.Uuid)
+	limitResources(cfg.Cgroups.Resources, task.Request.Resources)
+
 	container, err := factory.Create(task.Id.Uuid, cfg)
 	if err != nil {
 		return fmt.Errorf("error creating container: %s", err)
 	}
 	defer container.Destroy()
 
-	taskProcess, err := process(task)
+	r.containers.add(task.Id, container)
+	defer r.containers.remove(task.Id)
+
+	taskLog, err := createTaskLog(getLog(task.Id))
 	if err != nil {
-		return fmt.Errorf("error creating task process: %s", err)
+		return fmt.Errorf("error creating task log: %s", err)
 	}
 
-	// cancelCancel cancels the context used for task cancelation watching
+	taskProcess := process(task, taskLog)
+
+	// cancelCancel cancels the context used for task cancelation and timeout watching
 	cancelCtx, cancelCancel := context.WithCancel(ctx)
-	cancel := r.watchCancel(task, taskProcess, cancelCtx)
+	cancel := r.watchCancel(task, container, cancelCtx)
+	timedOut := r.watchTimeout(task, container, cancelCtx)
 	defer cancelCancel()
 
+	start := time.Now()
+
 	err = container.Run(taskProcess)
 	if err != nil {
+		taskLog.close()
 		return fmt.Errorf("error running task process: %s", err)
 	}
 
 	taskState, waitErr := taskProcess.Wait()
 	cancelCancel()
 
-	select {
-	// Task was cancelled, ignore waitErr as it's caused by kill()
-	case <-cancel:
+	// Wait returns once all the output of the task has been written
+	if err := taskLog.close(); err != nil {
+		log.Println("Error closing task log:", err)
+	}
+
+	// Wait for the watcher to stop, so we know if the task was canceled
+	// Task was cancelled, ignore waitErr as it's caused by the stop signal or kill()
+	if <-cancel {
+		return nil
+	}
+
+	// Task was killed for running too long, ignore waitErr for the same reason
+	if <-timedOut {
+		r.replicateLog(task)
+
+		if err := task.timeOut(context.Background(), r.client, r.id, time.Since(start)); err != nil {
+			return fmt.Errorf("error timing out task: %s", err)
+		}
 		return nil
+	}
 
 	// Task finished normally
-	default:
-		// wait() returns errors if exit_code != 0, if we have a real taskState, ignore the error
-		// Idealy we'd check if the error is a `genericError`, and has code `NoProcessOps`,
-		// but `genericError` is not a public type.
-		// See https://github.com/opencontainers/runc/blob/master/libcontainer/process.go#L82
-		// and https://github.com/opencontainers/runc/blob/master/libcontainer/generic_error.go#L69
-		if taskState == nil && waitErr != nil {
-			return fmt.Errorf("error waiting for task process: %s", waitErr)
+	// wait() returns errors if exit_code != 0, if we have a real taskState, ignore the error
+	// Idealy we'd check if the error is a `genericError`, and has code `NoProcessOps`,
+	// but `genericError` is not a public type.
+	// See https://github.com/opencontainers/runc/blob/master/libcontainer/process.go#L82
+	// and https://github.com/opencontainers/runc/blob/master/libcontainer/generic_error.go#L69
+	if taskState == nil && waitErr != nil {
+		return fmt.Errorf("error waiting for task process: %s", waitErr)
+	}
+
+	taskStatus, ok := taskState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return fmt.Errorf("error getting task process exit code")
+	}
+
+	// Tasks killed by a signal, like the OOM killer, exit with 128 + the signal like exec'd processes
+	code := int(exitCode(taskStatus))
+	usage := resourceUsage(container, time.Since(start))
+
+	// Retryable exit codes complete the task once it runs out of attempts, so its log is always replicated
+	r.replicateLog(task)
+
+	if task.isRetryableExitCode(code) {
+		err = task.retryExitCode(context.Background(), r.client, r.id, code, usage)
+	} else {
+		err = task.complete(context.Background(), r.client, r.id, code, usage)
+	}
+	if err != nil {
+		return fmt.Errorf("error completing task: %s", err)
+	}
+
+	return nil
+}
+
+// replicateLog replicates the log of a finished task, before its status is updated so it's there once the task is done.
+// Errors are only logged, the task is done regardless.
+func (r *Runner) replicateLog(task *Task) {
+	if err := replicateLog(context.Background(), r.client, task.Id, r.logReplicaSize); err != nil {
+		log.Println("Error replicating task log:", err)
+	}
+}
+
+// copyInputs copies the input files of task into its rootfs, from the node storing them.
+// They're owned by root in the task.
+func (r *Runner) copyInputs(ctx context.Context, task *Task, rootFs string) error {
+	if task.InputNode.Uuid == r.id.Uuid {
+		w := &fileWriter{root: rootFs, mapRoot: true}
+		defer w.close()
+
+		if err := sendFiles(getInputs(task.Id), "/", w.write); err != nil {
+			return err
+		}
+
+		return w.close()
+	}
+
+	client, conn, err := nodeClient(task.InputNode)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	inputs, err := client.Inputs(ctx, task.Id)
+	if err != nil {
+		return err
+	}
+
+	return receiveFiles(&fileWriter{root: rootFs, mapRoot: true}, inputs.Recv)
+}
+
+// steal tries to mark a queued Task as running on this node, and runs it if we succeed.
+// Tasks that can't be run yet are left queued, and deferred. Doesn't block.
+func (r *Runner) steal(ctx context.Context, task *Task, factory libcontainer.Factory, rootFs string) {
+	// The task might have been stolen since it was queued
+	if _, ok := task.Status.Status.(*api.TaskStatus_Queued_); !ok {
+		return
+	}
+
+	// Retried tasks wait out their backoff, deferred tasks are offered again once it's over.
+	// Deferred tasks might be offered again before then, only one wake up is needed per task.
+	if notBefore := time.Unix(task.Status.GetQueued().NotBefore, 0); notBefore.After(time.Now()) {
+		r.deferred.add(task)
+		if r.backingOff.add(task.Id) {
+			time.AfterFunc(time.Until(notBefore), func() {
+				r.backingOff.remove(task.Id)
+				r.signalWake()
+			})
 		}
+		return
+	}
+
+	// Stop stealing when we're full, deferred tasks are offered again when a task finishes
+	if !r.capacity.hasSlot() {
+		r.deferred.add(task)
+		return
+	}
+
+	// Tasks are offered again every time the queue is listed, only log them once
+	if !r.capacity.fits(task.Request.Resources) {
+		if r.oversized.add(task.Id) {
+			log.Println("Task", task.Id.Uuid, "requires more resources than this node has")
+		}
+		return
+	}
+
+	// Leave tasks we can't run to nodes that can, deferred tasks are offered again when an image is imported
+	if !r.hasImage(task, rootFs) {
+		r.deferred.add(task)
+		return
+	}
 
-		taskStatus, ok := taskState.Sys().(syscall.WaitStatus)
-		if !ok {
-			return fmt.Errorf("error getting task process exit code")
+	// Relisting the queue offers tasks we're already waiting to steal again
+	if !r.delaying.add(task.Id) {
+		return
+	}
+
+	// The task is ours until take is done with it, an older version shouldn't be offered again
+	r.deferred.remove(task.Id)
+
+	// Give less loaded nodes a chance to steal the task first, without holding up the rest of the queue
+	go func() {
+		defer r.delaying.remove(task.Id)
+
+		if !sleep(ctx, r.policy.delay()) {
+			return
 		}
 
-		err = task.complete(context.Background(), r.client, r.id, taskStatus.ExitStatus())
+		r.take(ctx, task, factory, rootFs)
+	}()
+}
+
+// take marks a queued Task as running on this node if it fits in our remaining capacity, and runs it if we succeed.
+func (r *Runner) take(ctx context.Context, task *Task, factory libcontainer.Factory, rootFs string) {
+	// Other tasks might have been taken while we waited, deferred tasks are offered again when capacity is freed
+	if !r.capacity.reserve(task.Request.Resources) {
+		r.deferred.add(task)
+		return
+	}
+
+	if err := task.run(ctx, r.client, r.id); err != nil {
+		r.capacity.release(task.Request.Resources)
+
+		switch err {
+		case ConcurrentTaskModErr:
+			// Expected, someone else took the task
+			r.counters.conflicted()
+		default:
+			log.Println("Error marking task as running:", err)
+		}
+		return
+	}
+
+	r.counters.stole()
+
+	log.Println("Running task", task.Id.Uuid)
+
+	go func(task *Task) {
+		defer r.capacity.release(task.Request.Resources)
+
+		err := r.runTask(ctx, task, factory, rootFs)
+		if err == nil {
+			return
+		}
+
+		err = task.retry(ctx, r.client, r.id, err)
 		if err != nil {
-			return fmt.Errorf("error completing task: %s", err)
+			// Not much we can do at this point...
+			log.Println("Error updating failed task:", err)
 		}
+	}(task)
+}
 
-		return nil
+// hasImage returns true if we have the image task is run in
+func (r *Runner) hasImage(task *Task, rootFs string) bool {
+	if task.Request.Image == "" {
+		return rootFs != ""
 	}
+
+	return r.images.has(task.Request.Image)
 }
 
-// Run starts a watcher waiing for tasks to run. Blocking.
-func (r *Runner) Run(ctx context.Context, containerDir string, rootFs string) error {
-	rootFs, err := filepath.Abs(rootFs)
-	if err != nil {
-		return fmt.Errorf("error getting absolute rootfs path: %s", err)
+// signalWake wakes up watch, without blocking if it's already been signaled
+func (r *Runner) signalWake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
 	}
+}
 
-	factory, err := libcontainer.New(containerDir, libcontainer.Cgroupfs, libcontainer.InitArgs(os.Args[0], "init"))
-	if err != nil {
-		return fmt.Errorf("error creating libcontainer factory: %s", err)
+// stealAll tries to steal every Task of a list of TaskEvents.
+func (r *Runner) stealAll(ctx context.Context, tasks []TaskEvent, factory libcontainer.Factory, rootFs string) {
+	for _, taskEvent := range tasks {
+		switch taskEvent.(type) {
+		case TaskUpdate:
+			r.steal(ctx, taskEvent.(TaskUpdate).task, factory, rootFs)
+
+		case TaskError:
+			log.Println("Error listing queued tasks:", taskEvent.(TaskError).err)
+		}
 	}
+}
 
-	// TODO - What does cgroupName do?
-	cfg := config(rootFs, "test")
+// stealDeferred tries to steal the deferred Tasks again, without listing the queue.
+func (r *Runner) stealDeferred(ctx context.Context, factory libcontainer.Factory, rootFs string) {
+	for _, task := range r.deferred.removeAll() {
+		r.steal(ctx, task, factory, rootFs)
+	}
+}
 
-	newTasks := watchQueuedTasks(ctx, r.client)
+// watch steals the queued backlog, then every Task queued after it, until ctx is canceled or the resync interval elapses.
+// Deferred tasks are offered again when capacity is freed, a retried task's backoff is over, or an image is imported.
+func (r *Runner) watch(ctx context.Context, factory libcontainer.Factory, rootFs string) error {
+	backlog, rev, err := listQueuedTasks(ctx, r.client)
+	if err != nil {
+		return fmt.Errorf("error listing queued tasks: %s", err)
+	}
 
-	for taskEvent := range newTasks {
+	r.health.set(nil)
+
+	// Forget the oversized tasks that aren't queued anymore, in case we missed them leaving the queue
+	var ids []*api.TaskID
+	for _, taskEvent := range backlog {
 		switch taskEvent.(type) {
 		case TaskUpdate:
-			task := taskEvent.(TaskUpdate).task
+			ids = append(ids, taskEvent.(TaskUpdate).task.Id)
+		case TaskError:
+			ids = append(ids, taskEvent.(TaskError).id)
+		}
+	}
+	r.oversized.retain(ids)
 
-			if err := task.run(ctx, r.client, r.id); err != nil {
-				switch err {
-				case ConcurrentTaskModErr:
-					// Expected, someone else took the task
-				default:
-					log.Println("Error marking task as running:", err)
-				}
-				continue
+	// The backlog has the current version of every deferred task
+	r.deferred.removeAll()
+
+	r.stealAll(ctx, backlog, factory, rootFs)
+
+	watchCtx, watchCancel := context.WithTimeout(ctx, r.resyncInterval)
+	defer watchCancel()
+
+	// Watch from the revision of the list, so we don't miss anything queued in between
+	queued := watchQueuedTasks(watchCtx, r.client, rev)
+
+	for {
+		var taskEvent TaskEvent
+		var ok bool
+
+		select {
+		case taskEvent, ok = <-queued:
+			if !ok {
+				return nil
 			}
 
-			log.Println("Running task", task.Id.Uuid)
+		case <-r.capacity.freed:
+			// Offer the tasks that didn't fit before again
+			r.stealDeferred(ctx, factory, rootFs)
+			continue
 
-			go func(task *Task) {
-				err := r.runTask(ctx, task, factory, cfg)
-				if err == nil {
-					return
-				}
+		case <-r.wake:
+			// Offer the tasks whose backoff is over again
+			r.stealDeferred(ctx, factory, rootFs)
+			continue
 
-				task.Attempts++
-				if task.Attempts >= taskAttempts {
-					err = task.fail(ctx, r.client, err)
-				} else {
-					err = task.queue(ctx, r.client)
-				}
+		case <-r.images.imported:
+			// Offer the tasks whose image we didn't have again
+			r.stealDeferred(ctx, factory, rootFs)
+			continue
+		}
 
-				if err != nil {
-					// Not much we can do at this point...
-					log.Println("Error updating failed task:", err)
-				}
-			}(task)
+		switch taskEvent.(type) {
+		case TaskUpdate:
+			r.steal(ctx, taskEvent.(TaskUpdate).task, factory, rootFs)
+
+		case TaskDelete:
+			// The task left the queue
+			id := taskEvent.(TaskDelete).id
+			r.deferred.remove(id)
+			r.oversized.remove(id)
+
+		case TaskWatchResumed:
+			log.Println("Resumed watching for queued tasks")
+			r.health.set(nil)
 
 		case TaskError:
-			log.Println("Error watching for queued tasks:", taskEvent.(TaskError).err)
+			taskError := taskEvent.(TaskError)
+			log.Println("Error watching for queued tasks:", taskError.err)
+
+			// Errors retrieving individual tasks don't stop us from stealing others
+			if taskError.id == nil {
+				r.health.set(taskError.err)
+			}
 		}
 	}
+}
+
+// Run starts a watcher waiing for tasks to run. Blocking.
+func (r *Runner) Run(ctx context.Context, containerDir string, rootFs string) error {
+	// Without a rootfs, only tasks with an image are run
+	if rootFs != "" {
+		var err error
+		if rootFs, err = filepath.Abs(rootFs); err != nil {
+			return fmt.Errorf("error getting absolute rootfs path: %s", err)
+		}
+	}
+
+	factory, err := libcontainer.New(containerDir, libcontainer.Cgroupfs, libcontainer.InitArgs(os.Args[0], "init"))
+	if err != nil {
+		return fmt.Errorf("error creating libcontainer factory: %s", err)
+	}
+
+	r.wake = make(chan struct{}, 1)
+	r.delaying = newTaskSet()
+	r.backingOff = newTaskSet()
+	r.oversized = newTaskSet()
+	r.deferred = newDeferredTasks()
+
+	backoff := minBackoff
+
+	// Periodically resync with the queue, in case we missed something.
+	// This also recovers from the watch being compacted.
+	for ctx.Err() == nil {
+		err := r.watch(ctx, factory, rootFs)
+		if err == nil {
+			backoff = minBackoff
+			continue
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Println(err)
+		r.health.set(err)
+
+		sleep(ctx, backoff)
+		backoff = nextBackoff(backoff)
+	}
 
 	return nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Defaults used to stop a canceled task, if its TaskRequest doesn't say
+const (
+	defaultStopSignal = unix.SIGTERM
+	defaultStopGrace  = 10 * time.Second
+)
+
+// signals are the stop signals tasks can ask for by name
+var signals = map[string]unix.Signal{
+	"HUP":  unix.SIGHUP,
+	"INT":  unix.SIGINT,
+	"QUIT": unix.SIGQUIT,
+	"KILL": unix.SIGKILL,
+	"USR1": unix.SIGUSR1,
+	"USR2": unix.SIGUSR2,
+	"TERM": unix.SIGTERM,
+}
+
+// parseSignal converts a signal name (with or without the SIG prefix) or number to a signal.
+// An empty name is the default stop signal.
+func parseSignal(name string) (unix.Signal, error) {
+	if name == "" {
+		return defaultStopSignal, nil
+	}
+
+	if num, err := strconv.Atoi(name); err == nil {
+		if num <= 0 || num > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", num)
+		}
+		return unix.Signal(num), nil
+	}
+
+	signal, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %s", name)
+	}
+
+	return signal, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestParseSignal tests signals can be given by name or number
+func TestParseSignal(t *testing.T) {
+	for name, expected := range map[string]unix.Signal{
+		"":        defaultStopSignal,
+		"SIGTERM": unix.SIGTERM,
+		"int":     unix.SIGINT,
+		"9":       unix.SIGKILL,
+	} {
+		signal, err := parseSignal(name)
+		if err != nil {
+			t.Errorf("Unexpected error parsing signal %s: %v", name, err)
+		}
+		if signal != expected {
+			t.Errorf("parseSignal(%s) = %v, expected %v", name, signal, expected)
+		}
+	}
+
+	for _, name := range []string{"SIGFOO", "0", "-1", "100"} {
+		if _, err := parseSignal(name); err == nil {
+			t.Errorf("Expected error parsing signal %s", name)
+		}
+	}
+}
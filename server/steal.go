@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arthurfabre/scheduler/api"
+)
+
+// Load metrics a stealPolicy can use
+const (
+	// Fraction of task slots used, or running tasks per allocatable CPU
+	taskLoadMetric = "tasks"
+
+	// 1 minute load average per CPU
+	cpuLoadMetric = "loadavg"
+)
+
+// stealPolicy decides how long to wait between seeing a queued task and trying to steal it.
+// Loaded nodes wait longer, giving idle nodes a chance to win the race.
+type stealPolicy struct {
+	// maxDelay is the delay when the node is fully loaded
+	maxDelay time.Duration
+
+	// jitter is the maximum random delay added, so nodes with the same load don't all race
+	jitter time.Duration
+
+	// load returns the load of the node, 0 being idle and 1 fully loaded. Higher values are capped to 1.
+	load func() (float64, error)
+}
+
+// newStealPolicy creates a stealPolicy using load metric (taskLoadMetric or cpuLoadMetric) of c
+func newStealPolicy(maxDelay time.Duration, jitter time.Duration, metric string, c *capacity) (*stealPolicy, error) {
+	policy := &stealPolicy{maxDelay: maxDelay, jitter: jitter}
+
+	switch metric {
+	case taskLoadMetric:
+		policy.load = func() (float64, error) {
+			return c.taskLoad(), nil
+		}
+	case cpuLoadMetric:
+		policy.load = cpuLoad
+	default:
+		return nil, fmt.Errorf("unknown load metric %s", metric)
+	}
+
+	return policy, nil
+}
+
+// cpuLoad returns the 1 minute load average of the host, per CPU
+func cpuLoad() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing /proc/loadavg: %s", err)
+	}
+
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// delay returns how long to wait before trying to steal a task
+func (p *stealPolicy) delay() time.Duration {
+	load, err := p.load()
+	if err != nil {
+		// Don't hold up stealing because we can't tell how loaded we are
+		log.Println("Error getting node load:", err)
+		load = 0
+	}
+
+	if load > 1 {
+		load = 1
+	}
+
+	delay := time.Duration(load * float64(p.maxDelay))
+
+	if p.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+
+	return delay
+}
+
+// stealCounters counts the outcome of attempts to steal tasks. Safe for concurrent use.
+type stealCounters struct {
+	// steals is the number of tasks successfully stolen
+	steals uint64
+
+	// conflicts is the number of tasks someone else stole before we could (ConcurrentTaskModErr)
+	conflicts uint64
+}
+
+// stole records a successful steal
+func (c *stealCounters) stole() {
+	atomic.AddUint64(&c.steals, 1)
+}
+
+// conflicted records a steal lost to another node
+func (c *stealCounters) conflicted() {
+	atomic.AddUint64(&c.conflicts, 1)
+}
+
+// get returns the number of successful steals, and of steals lost to other nodes
+func (c *stealCounters) get() (uint64, uint64) {
+	return atomic.LoadUint64(&c.steals), atomic.LoadUint64(&c.conflicts)
+}
+
+// taskSet is a set of tasks. Safe for concurrent use.
+type taskSet struct {
+	sync.Mutex
+
+	ids map[string]struct{}
+}
+
+// newTaskSet returns an empty taskSet
+func newTaskSet() *taskSet {
+	return &taskSet{ids: make(map[string]struct{})}
+}
+
+// add adds the task with id, and returns false if it was already in the set
+func (s *taskSet) add(id *api.TaskID) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.ids[id.Uuid]; ok {
+		return false
+	}
+
+	s.ids[id.Uuid] = struct{}{}
+	return true
+}
+
+// remove removes the task with id
+func (s *taskSet) remove(id *api.TaskID) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.ids, id.Uuid)
+}
+
+// retain removes the tasks that aren't in ids
+func (s *taskSet) retain(ids []*api.TaskID) {
+	s.Lock()
+	defer s.Unlock()
+
+	keep := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		keep[id.Uuid] = struct{}{}
+	}
+
+	for id := range s.ids {
+		if _, ok := keep[id]; !ok {
+			delete(s.ids, id)
+		}
+	}
+}
+
+// deferredTasks are queued tasks that couldn't be run yet, kept to offer them again without listing the queue.
+// Safe for concurrent use.
+type deferredTasks struct {
+	sync.Mutex
+
+	tasks map[string]*Task
+}
+
+// newDeferredTasks returns an empty deferredTasks
+func newDeferredTasks() *deferredTasks {
+	return &deferredTasks{tasks: make(map[string]*Task)}
+}
+
+// add adds task, replacing any previous version of it
+func (d *deferredTasks) add(task *Task) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.tasks[task.Id.Uuid] = task
+}
+
+// remove removes the task with id
+func (d *deferredTasks) remove(id *api.TaskID) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.tasks, id.Uuid)
+}
+
+// removeAll removes and returns every task
+func (d *deferredTasks) removeAll() []*Task {
+	d.Lock()
+	defer d.Unlock()
+
+	tasks := make([]*Task, 0, len(d.tasks))
+	for _, task := range d.tasks {
+		tasks = append(tasks, task)
+	}
+	d.tasks = make(map[string]*Task)
+
+	return tasks
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arthurfabre/scheduler/api"
+	"github.com/arthurfabre/scheduler/server/pb"
+)
+
+// TestStealDelay tests the steal delay is proportional to load
+func TestStealDelay(t *testing.T) {
+	load := 0.0
+	policy := &stealPolicy{maxDelay: time.Second, load: func() (float64, error) { return load, nil }}
+
+	for _, l := range []float64{0, 0.5, 1, 2} {
+		load = l
+
+		expected := time.Duration(l * float64(time.Second))
+		if expected > time.Second {
+			expected = time.Second
+		}
+
+		if delay := policy.delay(); delay != expected {
+			t.Errorf("delay() with load %v = %v, expected %v", l, delay, expected)
+		}
+	}
+}
+
+// TestTaskSet tests tasks are only added to a taskSet once, until they're removed
+func TestTaskSet(t *testing.T) {
+	set := newTaskSet()
+	id := &api.TaskID{Uuid: "a"}
+
+	if !set.add(id) {
+		t.Errorf("Expected task to be added")
+	}
+	if set.add(&api.TaskID{Uuid: "a"}) {
+		t.Errorf("Expected task not to be added twice")
+	}
+	if !set.add(&api.TaskID{Uuid: "b"}) {
+		t.Errorf("Expected other task to be added")
+	}
+
+	set.remove(id)
+	if !set.add(id) {
+		t.Errorf("Expected removed task to be added again")
+	}
+
+	set.retain([]*api.TaskID{{Uuid: "b"}})
+	if !set.add(id) {
+		t.Errorf("Expected task not retained to be added again")
+	}
+	if set.add(&api.TaskID{Uuid: "b"}) {
+		t.Errorf("Expected retained task not to be added again")
+	}
+}
+
+// TestDeferredTasks tests only the latest version of deferred tasks is kept, until they're removed
+func TestDeferredTasks(t *testing.T) {
+	deferred := newDeferredTasks()
+
+	old := &Task{Task: &pb.Task{Id: &api.TaskID{Uuid: "a"}}, modRevision: 1}
+	latest := &Task{Task: &pb.Task{Id: &api.TaskID{Uuid: "a"}}, modRevision: 2}
+	other := &Task{Task: &pb.Task{Id: &api.TaskID{Uuid: "b"}}, modRevision: 3}
+
+	deferred.add(old)
+	deferred.add(latest)
+	deferred.add(other)
+	deferred.remove(other.Id)
+
+	tasks := deferred.removeAll()
+	if len(tasks) != 1 || tasks[0] != latest {
+		t.Errorf("Expected only the latest version of the deferred task, got %v", tasks)
+	}
+
+	if tasks := deferred.removeAll(); len(tasks) != 0 {
+		t.Errorf("Expected no deferred tasks once they're removed, got %v", tasks)
+	}
+}
@@ -4,29 +4,52 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"path"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/clientv3util"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/satori/go.uuid"
+	"golang.org/x/sys/unix"
 
 	"github.com/arthurfabre/scheduler/api"
 	"github.com/arthurfabre/scheduler/server/pb"
 )
 
 // Format strings for prefixes. A prefix is a key with everything but the last Task UUID component
+// Epochs are zero padded, so keys sort in epoch order.
 // See README/#ETCD Key Schema
 const (
-	taskPrefix        = "task/"
-	queuedPrefixFmt   = "task/status/queued/"
-	runningPrefixFmt  = "task/status/running/%s/"
-	completePrefixFmt = "task/status/complete/%d/"
-	canceledPrefixFmt = "task/status/canceled/%d/"
-	failedPrefixFmt   = "task/status/failed/"
+	taskPrefix          = "task/"
+	statusPrefixFmt     = "task/status/"
+	queuedPrefixFmt     = "task/status/queued/"
+	allRunningPrefixFmt = "task/status/running/"
+	runningPrefixFmt    = "task/status/running/%s/"
+	completePrefixFmt   = "task/status/complete/%020d/"
+	canceledPrefixFmt   = "task/status/canceled/%020d/"
+	failedPrefixFmt     = "task/status/failed/%020d/"
+	timedOutPrefixFmt   = "task/status/timedout/%020d/"
+)
+
+// defaultMaxAttempts is the maximum number of times we attempt to run a task, if its RetryPolicy doesn't say
+const defaultMaxAttempts = 3
+
+// Image names are checked against these
+const maxImageNameLen = 255
+
+var imageNameRegexp = regexp.MustCompile("^[a-z0-9][a-z0-9._-]*(:[0-9]+)?(/[a-z0-9][a-z0-9._-]*)*(:[a-zA-Z0-9._-]+)?$")
+
+// Backoff bounds used when retrying failed etcd operations
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
 )
 
 var (
@@ -76,15 +99,19 @@ type TaskError struct {
 
 func (t TaskError) isTaskEvent() {}
 
-// watchQueuedTasks returns a Channel of TaskEvents for Tasks that have just been queued
-func watchQueuedTasks(ctx context.Context, client KVWatcher) <-chan TaskEvent {
-	return watchTasks(ctx, client, queuedPrefix(), clientv3.WithPrefix())
+// TaskWatchResumed means a watch recovered from an error. No events were missed.
+type TaskWatchResumed struct{}
+
+func (t TaskWatchResumed) isTaskEvent() {}
+
+// watchQueuedTasks returns a Channel of TaskEvents for Tasks that have been queued since etcd revision rev
+func watchQueuedTasks(ctx context.Context, client KVWatcher, rev int64) <-chan TaskEvent {
+	return watchTasks(ctx, client, queuedPrefix(), rev, clientv3.WithPrefix())
 }
 
 // watch returns a Channel of TaskEvent updates to this Task since this task was last updated / retrieved
 func (t *Task) watch(ctx context.Context, client KVWatcher) <-chan TaskEvent {
-	// Revision + 1 so we don't get the last modification we're aware of, but the next
-	return watchTasks(ctx, client, t.key, clientv3.WithRev(t.modRevision+1))
+	return watchTasks(ctx, client, t.key, t.modRevision)
 }
 
 // KVWatcher combines clientv3.KV and clientv3.Watcher interfaces
@@ -93,76 +120,173 @@ type KVWatcher interface {
 	clientv3.Watcher
 }
 
-// watchTasks returns a Channel of TaskEvent using etcd WATCH(key, opts...)
-func watchTasks(ctx context.Context, client KVWatcher, key string, opts ...clientv3.OpOption) <-chan TaskEvent {
+// watchTasks returns a Channel of TaskEvent using etcd WATCH(key, opts...), for modifications made after revision rev.
+// If the watch fails, a TaskError (with no id) is sent, and the watch is resumed with backoff from the last revision seen.
+// Once it has resumed, a TaskWatchResumed is sent.
+// If the revisions we need have been compacted, a TaskError with rpctypes.ErrCompacted is sent and the channel is closed:
+// callers have to list what they're interested in again.
+func watchTasks(ctx context.Context, client KVWatcher, key string, rev int64, opts ...clientv3.OpOption) <-chan TaskEvent {
 	out := make(chan TaskEvent)
 
 	go func() {
 		defer close(out)
 
-		for resp := range client.Watch(ctx, key, opts...) {
-			if resp.Err() != nil {
-				out <- TaskError{resp.Err(), nil}
+		backoff := minBackoff
+
+		for {
+			err := watchTasksFrom(ctx, client, out, key, &rev, opts)
+			if ctx.Err() != nil {
 				return
 			}
 
-			for _, ev := range resp.Events {
-				// ev.Kv.Value only works if we're matching Tasks and not status keys...
-				task, err := getTask(ctx, client, taskID(string(ev.Kv.Key)))
-
-				if err != nil {
-					out <- TaskError{err, taskID(string(ev.Kv.Key))}
-					continue
+			for {
+				if !sendTaskEvent(ctx, out, TaskError{err, nil}) || err == rpctypes.ErrCompacted {
+					return
 				}
 
-				switch ev.Type {
-				case mvccpb.DELETE:
-					out <- TaskDelete{task.Id}
+				if !sleep(ctx, backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
 
-				case mvccpb.PUT:
-					out <- TaskUpdate{task}
+				// Ensure etcd is reachable, and the revision we need hasn't been compacted
+				_, err = client.Get(ctx, key, append([]clientv3.OpOption{clientv3.WithRev(rev), clientv3.WithCountOnly()}, opts...)...)
+				if err == nil {
+					break
+				}
+				if ctx.Err() != nil {
+					return
 				}
 			}
+
+			backoff = minBackoff
+
+			if !sendTaskEvent(ctx, out, TaskWatchResumed{}) {
+				return
+			}
 		}
 	}()
 
 	return out
 }
 
-// listDoneTasks returns a list of TaskEvents (no TaskDelete) that were done (completed or canceled) at least age seconds ago.
-func listDoneTasks(ctx context.Context, client clientv3.KV, age int64) ([]TaskEvent, error) {
-	// Get everything from epoch 0 to (Now - age)
-	end := time.Now().Unix() - age
+// watchTasksFrom sends TaskEvents to out for modifications to key after revision rev, updating rev as events are seen.
+// Returns the error that interrupted the watch.
+func watchTasksFrom(ctx context.Context, client KVWatcher, out chan<- TaskEvent, key string, rev *int64, opts []clientv3.OpOption) error {
+	// Ensure we don't leak the watch if we stop early
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
 
-	completed, err := listTasks(ctx, client, completePrefix(0), clientv3.WithRange(completePrefix(end)))
-	if err != nil {
-		return nil, err
+	// Revision + 1 so we don't get the last modification we're aware of, but the next
+	watchOpts := append([]clientv3.OpOption{clientv3.WithRev(*rev + 1)}, opts...)
+
+	for resp := range client.Watch(watchCtx, key, watchOpts...) {
+		if resp.Err() != nil {
+			return resp.Err()
+		}
+
+		for _, ev := range resp.Events {
+			id := taskID(string(ev.Kv.Key))
+
+			var taskEvent TaskEvent
+
+			switch ev.Type {
+			case mvccpb.DELETE:
+				taskEvent = TaskDelete{id}
+
+			case mvccpb.PUT:
+				// ev.Kv.Value only works if we're matching Tasks and not status keys...
+				// Get the Task as of this event, as it might have been modified since.
+				task, err := getTask(ctx, client, id, clientv3.WithRev(ev.Kv.ModRevision))
+				if err == rpctypes.ErrCompacted {
+					// The revision of the event has been compacted since, the Task as of now is as good
+					task, err = getTask(ctx, client, id)
+				}
+				if err != nil {
+					taskEvent = TaskError{err, id}
+				} else {
+					taskEvent = TaskUpdate{task}
+				}
+			}
+
+			if !sendTaskEvent(ctx, out, taskEvent) {
+				return ctx.Err()
+			}
+
+			*rev = ev.Kv.ModRevision
+		}
 	}
 
-	canceled, err := listTasks(ctx, client, canceledPrefix(0), clientv3.WithRange(canceledPrefix(end)))
-	if err != nil {
-		return nil, err
+	return fmt.Errorf("watch closed")
+}
+
+// sleep waits for d, unless ctx is canceled first.
+// Returns false IFF ctx was canceled.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// nextBackoff returns the backoff to use after backoff, doubling it up to maxBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
 	}
 
-	return append(completed, canceled...), nil
+	return backoff
+}
+
+// sendTaskEvent writes taskEvent to out, unless ctx is canceled first.
+// Returns false IFF ctx was canceled, so watchers don't leak blocked on a channel no one reads.
+func sendTaskEvent(ctx context.Context, out chan<- TaskEvent, taskEvent TaskEvent) bool {
+	select {
+	case out <- taskEvent:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// listQueuedTasks returns a list of TaskEvents (no TaskDelete) for Tasks that are queued,
+// and the etcd revision the list was retrieved at.
+func listQueuedTasks(ctx context.Context, client clientv3.KV) ([]TaskEvent, int64, error) {
+	return listTasks(ctx, client, queuedPrefix(), clientv3.WithPrefix())
+}
+
+// listDoneTasks returns a list of TaskEvents (no TaskDelete) that were done at least age seconds ago.
+// prefix is the status key prefix for tasks done at a given epoch (completePrefix, canceledPrefix, failedPrefix or timedOutPrefix).
+func listDoneTasks(ctx context.Context, client clientv3.KV, prefix func(int64) string, age int64) ([]TaskEvent, error) {
+	// Get everything from epoch 0 to (Now - age)
+	end := time.Now().Unix() - age
+
+	tasks, _, err := listTasks(ctx, client, prefix(0), clientv3.WithRange(prefix(end)))
+	return tasks, err
 }
 
 // listNodeTasks returns a list of TaskEvents (no TaskDelete) that are being run by nodeId.
 func listNodeTasks(ctx context.Context, client clientv3.KV, nodeId *api.NodeID) ([]TaskEvent, error) {
-	return listTasks(ctx, client, runningPrefix(nodeId), clientv3.WithPrefix())
+	tasks, _, err := listTasks(ctx, client, runningPrefix(nodeId), clientv3.WithPrefix())
+	return tasks, err
 }
 
-// listTasks returns a list of TaskEvents (no TaskDelete) using etcd GET(key, opts...). Intended to be used with status keys.
-func listTasks(ctx context.Context, client clientv3.KV, key string, opts ...clientv3.OpOption) ([]TaskEvent, error) {
+// listTasks returns a list of TaskEvents (no TaskDelete) using etcd GET(key, opts...), and the etcd revision of the GET.
+// Intended to be used with status keys.
+func listTasks(ctx context.Context, client clientv3.KV, key string, opts ...clientv3.OpOption) ([]TaskEvent, int64, error) {
 	resp, err := client.Get(ctx, key, opts...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	tasks := make([]TaskEvent, 0, resp.Count)
 
 	for _, t := range resp.Kvs {
-		task, err := parseTask(t)
+		// Status keys have no values, fetch the actual Task
+		task, err := getTask(ctx, client, taskID(string(t.Key)))
 
 		if err != nil {
 			tasks = append(tasks, TaskError{err, taskID(string(t.Key))})
@@ -172,7 +296,7 @@ func listTasks(ctx context.Context, client clientv3.KV, key string, opts ...clie
 		tasks = append(tasks, TaskUpdate{task})
 	}
 
-	return tasks, nil
+	return tasks, resp.Header.Revision, nil
 }
 
 // newTask constructs a Task from a TaskRequest, assigining it a UUID.
@@ -188,15 +312,15 @@ func newTask(req *api.TaskRequest) (*Task, error) {
 	return &Task{key: taskKey(id), Task: &pb.Task{Request: req, Id: id}}, nil
 }
 
-// getTask retrieves a Task from etcd. id is sanitized / checked.
-func getTask(ctx context.Context, client clientv3.KV, id *api.TaskID) (*Task, error) {
+// getTask retrieves a Task from etcd using etcd GET(key, opts...). id is sanitized / checked.
+func getTask(ctx context.Context, client clientv3.KV, id *api.TaskID, opts ...clientv3.OpOption) (*Task, error) {
 	if err := checkTaskID(id); err != nil {
 		return nil, err
 	}
 
 	key := taskKey(id)
 
-	resp, err := client.Get(ctx, key)
+	resp, err := client.Get(ctx, key, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -241,6 +365,11 @@ func checkTask(task *Task) error {
 	if err := checkTaskID(task.Id); err != nil {
 		return err
 	}
+	if task.InputNode != nil {
+		if err := checkNodeID(task.InputNode); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -281,6 +410,21 @@ func checkTaskStatus(status *api.TaskStatus) error {
 			return fmt.Errorf("TaskStatus.Failed missing required field error")
 		}
 
+		if status.GetFailed().Epoch == 0 {
+			return fmt.Errorf("TaskStatus.Failed missing required field epoch")
+		}
+
+		return nil
+
+	case *api.TaskStatus_TimedOut_:
+		if err := checkNodeID(status.GetTimedOut().NodeId); err != nil {
+			return err
+		}
+
+		if status.GetTimedOut().Epoch == 0 {
+			return fmt.Errorf("TaskStatus.TimedOut missing required field epoch")
+		}
+
 		return nil
 
 	default:
@@ -300,6 +444,124 @@ func checkTaskRequest(req *api.TaskRequest) error {
 		return fmt.Errorf("TaskRequest missing required field command")
 	}
 
+	if err := checkResources(req.Resources); err != nil {
+		return err
+	}
+
+	if err := checkRetryPolicy(req.Retry); err != nil {
+		return err
+	}
+
+	if _, err := parseSignal(req.StopSignal); err != nil {
+		return fmt.Errorf("TaskRequest field stop_signal invalid: %s", err)
+	}
+
+	if err := checkEnv(req.Env); err != nil {
+		return err
+	}
+
+	if req.WorkingDir != "" && !path.IsAbs(req.WorkingDir) {
+		return fmt.Errorf("TaskRequest field working_dir must be an absolute path")
+	}
+
+	if err := checkUser(req.User); err != nil {
+		return err
+	}
+
+	if req.Image != "" {
+		if err := checkImageName(req.Image); err != nil {
+			return fmt.Errorf("TaskRequest field image invalid: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// checkEnv ensures every environment variable is of the form KEY=VALUE
+func checkEnv(env []string) error {
+	for _, v := range env {
+		if strings.IndexByte(v, '=') <= 0 {
+			return fmt.Errorf("TaskRequest field env has invalid variable %q, expected KEY=VALUE", v)
+		}
+
+		if strings.IndexByte(v, 0) >= 0 {
+			return fmt.Errorf("TaskRequest field env has variable %q containing a NUL byte", v)
+		}
+	}
+
+	return nil
+}
+
+// checkUser ensures a user is of the form user, uid, user:group or uid:gid. user is optional.
+func checkUser(user string) error {
+	if user == "" {
+		return nil
+	}
+
+	parts := strings.Split(user, ":")
+	if len(parts) > 2 {
+		return fmt.Errorf("TaskRequest field user has invalid user %q, expected user or user:group", user)
+	}
+
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t\n/") {
+			return fmt.Errorf("TaskRequest field user has invalid user %q, expected user or user:group", user)
+		}
+	}
+
+	return nil
+}
+
+// checkImageName ensures an image name is of the form [registry[:port]/]repository[:tag]
+func checkImageName(name string) error {
+	if len(name) > maxImageNameLen || !imageNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+
+	return nil
+}
+
+// checkRetryPolicy ensures a RetryPolicy is consistent. RetryPolicy is optional.
+func checkRetryPolicy(policy *api.RetryPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxBackoffSeconds != 0 && policy.MaxBackoffSeconds < policy.BackoffSeconds {
+		return fmt.Errorf("RetryPolicy field max_backoff_seconds is less than backoff_seconds")
+	}
+
+	return nil
+}
+
+// checkResources ensures the limits of Resources are sane. Resources are optional.
+func checkResources(res *api.Resources) error {
+	if res == nil {
+		return nil
+	}
+
+	// The kernel enforces a minimum of 2 shares
+	if res.CpuShares == 1 {
+		return fmt.Errorf("Resources field cpu_shares must be at least 2")
+	}
+
+	if res.CpuMillis > math.MaxInt64/cpuPeriod {
+		return fmt.Errorf("Resources field cpu_millis too large")
+	}
+
+	// The kernel enforces a minimum quota of 1ms per period
+	if res.CpuMillis != 0 && res.CpuMillis*cpuPeriod/1000 < 1000 {
+		return fmt.Errorf("Resources field cpu_millis must be at least %d", 1000*1000/cpuPeriod)
+	}
+
+	if res.MemoryBytes > math.MaxInt64 {
+		return fmt.Errorf("Resources field memory_bytes too large")
+	}
+
+	if res.Pids > math.MaxInt64 {
+		return fmt.Errorf("Resources field pids too large")
+	}
+
 	return nil
 }
 
@@ -342,11 +604,21 @@ func taskKey(id *api.TaskID) string {
 	return idKey(taskPrefix, id)
 }
 
+// statusPrefix returns the status key prefix for tasks of any status
+func statusPrefix() string {
+	return statusPrefixFmt
+}
+
 // queuedPrefix returns the status key prefix for queued tasks
 func queuedPrefix() string {
 	return queuedPrefixFmt
 }
 
+// allRunningPrefix returns the status key prefix for tasks running on any node
+func allRunningPrefix() string {
+	return allRunningPrefixFmt
+}
+
 // runningPrefix returns the status key prefix for tasks running on id
 func runningPrefix(id *api.NodeID) string {
 	return fmt.Sprintf(runningPrefixFmt, id.Uuid)
@@ -362,9 +634,14 @@ func canceledPrefix(age int64) string {
 	return fmt.Sprintf(canceledPrefixFmt, age)
 }
 
-// failedPrefix returns the status key prefix for failed tasks
-func failedPrefix() string {
-	return failedPrefixFmt
+// failedPrefix returns the status key prefix for tasks failed at age
+func failedPrefix(age int64) string {
+	return fmt.Sprintf(failedPrefixFmt, age)
+}
+
+// timedOutPrefix returns the status key prefix for tasks timed out at age
+func timedOutPrefix(age int64) string {
+	return fmt.Sprintf(timedOutPrefixFmt, age)
 }
 
 // statusKey returns the etcd status key of a Task for a given TaskStatus
@@ -381,7 +658,9 @@ func (t *Task) statusKey(status *api.TaskStatus) string {
 	case *api.TaskStatus_Canceled_:
 		prefix = canceledPrefix(status.GetCanceled().Epoch)
 	case *api.TaskStatus_Failed_:
-		prefix = failedPrefix()
+		prefix = failedPrefix(status.GetFailed().Epoch)
+	case *api.TaskStatus_TimedOut_:
+		prefix = timedOutPrefix(status.GetTimedOut().Epoch)
 	default:
 		// TODO - Is this wise?
 		panic("Unexpected Task status")
@@ -396,6 +675,12 @@ func taskID(key string) *api.TaskID {
 	return &api.TaskID{Uuid: s[len(s)-1]}
 }
 
+// runningNodeID converts a running status key to the NodeID running the task. Only the UUID is set.
+func runningNodeID(key string) *api.NodeID {
+	s := strings.Split(strings.TrimPrefix(key, allRunningPrefix()), "/")
+	return &api.NodeID{Uuid: s[0]}
+}
+
 // idKey converts a key prefix to full status / task key
 func idKey(prefix string, key *api.TaskID) string {
 	return prefix + key.Uuid
@@ -404,7 +689,7 @@ func idKey(prefix string, key *api.TaskID) string {
 // setStatus Updates the status of a Task, and updates the Task and its status key in etcd
 // newStatus is sanitized / checked
 // err is a ConcurrentTaskModErr IFF the task was modified before we could set the status
-func (t *Task) setStatus(ctx context.Context, client clientv3.KV, newStatus *api.TaskStatus) (err error) {
+func (t *Task) setStatus(ctx context.Context, client clientv3.KV, newStatus *api.TaskStatus) error {
 	if err := checkTaskStatus(newStatus); err != nil {
 		return err
 	}
@@ -414,6 +699,12 @@ func (t *Task) setStatus(ctx context.Context, client clientv3.KV, newStatus *api
 		return fmt.Errorf("task already has status %T", t.Status.Status)
 	}
 
+	return t.putStatus(ctx, client, newStatus)
+}
+
+// putStatus stores the Task with newStatus, and updates its status key in etcd.
+// err is a ConcurrentTaskModErr IFF the task was modified before we could set the status
+func (t *Task) putStatus(ctx context.Context, client clientv3.KV, newStatus *api.TaskStatus) (err error) {
 	// Preserve old status to know which old key to delete
 	oldStatus := t.Status
 	t.Status = newStatus
@@ -437,8 +728,8 @@ func (t *Task) setStatus(ctx context.Context, client clientv3.KV, newStatus *api
 		clientv3.OpPut(t.statusKey(newStatus), ""),
 	}
 
-	// If a previous status was set, cleanup its key
-	if oldStatus != nil {
+	// If a previous status was set, cleanup its key (unless it hasn't changed)
+	if oldStatus != nil && t.statusKey(oldStatus) != t.statusKey(newStatus) {
 		thens = append(thens, clientv3.OpDelete(t.statusKey(oldStatus)))
 	}
 
@@ -481,17 +772,183 @@ func (t *Task) run(ctx context.Context, client clientv3.KV, nodeID *api.NodeID)
 	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Running_{&api.TaskStatus_Running{nodeID}}})
 }
 
-// complete marks the Task as "complete" on nodeID, with exitCode, as of now, in etcd.
-func (t *Task) complete(ctx context.Context, client clientv3.KV, nodeID *api.NodeID, exitCode int) error {
-	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Complete_{&api.TaskStatus_Complete{nodeID, int32(exitCode), time.Now().Unix()}}})
+// complete marks the Task as "complete" on nodeID, with exitCode and usage, as of now, in etcd.
+func (t *Task) complete(ctx context.Context, client clientv3.KV, nodeID *api.NodeID, exitCode int, usage *api.ResourceUsage) error {
+	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Complete_{&api.TaskStatus_Complete{nodeID, int32(exitCode), time.Now().Unix(), usage}}})
 }
 
-// cancel marks the Task as "canceled" as of now, in etcd.
-func (t *Task) cancel(ctx context.Context, client clientv3.KV) error {
-	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Canceled_{&api.TaskStatus_Canceled{time.Now().Unix()}}})
+// cancel marks the Task as "canceled" as of now, in etcd. If force is true, the Task is killed without a grace period.
+func (t *Task) cancel(ctx context.Context, client clientv3.KV, force bool) error {
+	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Canceled_{&api.TaskStatus_Canceled{time.Now().Unix(), force}}})
 }
 
-// queue marks the Task as "error" with msg, in etcd.
+// forceCancel marks an already canceled Task to be killed without waiting for the rest of its grace period, in etcd.
+func (t *Task) forceCancel(ctx context.Context, client clientv3.KV) error {
+	canceled := t.Status.GetCanceled()
+	if canceled == nil {
+		return fmt.Errorf("task isn't canceled")
+	}
+
+	// Keep the original epoch, so the status key doesn't change
+	return t.putStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Canceled_{&api.TaskStatus_Canceled{canceled.Epoch, true}}})
+}
+
+// stopSignal returns the signal sent to the Task when it is canceled
+func (t *Task) stopSignal() unix.Signal {
+	// Checked by checkTaskRequest
+	signal, _ := parseSignal(t.Request.StopSignal)
+	return signal
+}
+
+// stopGrace returns how long the Task has to exit after its stop signal, before being killed
+func (t *Task) stopGrace() time.Duration {
+	if t.Request.StopGraceSeconds == 0 {
+		return defaultStopGrace
+	}
+
+	return time.Duration(t.Request.StopGraceSeconds) * time.Second
+}
+
+// fail marks the Task as "error" with msg, as of now, in etcd.
 func (t *Task) fail(ctx context.Context, client clientv3.KV, err error) error {
-	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Failed_{&api.TaskStatus_Failed{err.Error()}}})
+	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Failed_{&api.TaskStatus_Failed{err.Error(), time.Now().Unix()}}})
+}
+
+// timeOut marks the Task as "timed out" on nodeID after running for elapsed, as of now, in etcd.
+func (t *Task) timeOut(ctx context.Context, client clientv3.KV, nodeID *api.NodeID, elapsed time.Duration) error {
+	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_TimedOut_{&api.TaskStatus_TimedOut{nodeID, int64(elapsed.Seconds()), time.Now().Unix()}}})
+}
+
+// timeout returns how long the Task can run for before being killed, 0 for no limit
+func (t *Task) timeout() time.Duration {
+	return time.Duration(t.Request.TimeoutSeconds) * time.Second
+}
+
+// delete removes the Task, its status key and its log replica from etcd.
+// err is a ConcurrentTaskModErr IFF the task was modified before we could delete it
+func (t *Task) delete(ctx context.Context, client clientv3.KV) error {
+	resp, err := client.Txn(ctx).If(
+		clientv3.Compare(clientv3.Version(t.key), "=", t.version),
+	).Then(
+		clientv3.OpDelete(t.key),
+		clientv3.OpDelete(t.statusKey(t.Status)),
+		clientv3.OpDelete(logKey(t.Id)),
+	).Commit()
+
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return ConcurrentTaskModErr
+	}
+
+	return nil
+}
+
+// maxAttempts returns the maximum number of attempts at running the Task
+func (t *Task) maxAttempts() uint32 {
+	if t.Request.Retry == nil || t.Request.Retry.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+
+	return t.Request.Retry.MaxAttempts
+}
+
+// retryBackoff returns how long to wait before the next attempt at running the Task, given the attempts made so far
+func (t *Task) retryBackoff() time.Duration {
+	policy := t.Request.Retry
+	if policy == nil || policy.BackoffSeconds == 0 || t.Attempts == 0 {
+		return 0
+	}
+
+	backoff := time.Duration(policy.BackoffSeconds) * time.Second
+	max := time.Duration(policy.MaxBackoffSeconds) * time.Second
+
+	// Double for every retry after the first, stopping before we overflow
+	for i := uint32(1); i < t.Attempts && backoff < math.MaxInt64/2; i++ {
+		backoff *= 2
+	}
+
+	if max > 0 && backoff > max {
+		return max
+	}
+
+	return backoff
+}
+
+// isRetryableExitCode returns true if exitCode counts as a failure to be retried
+func (t *Task) isRetryableExitCode(exitCode int) bool {
+	if t.Request.Retry == nil {
+		return false
+	}
+
+	for _, code := range t.Request.Retry.RetryExitCodes {
+		if int(code) == exitCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordAttempt records a failed attempt at running the Task, returning true if it can be retried.
+func (t *Task) recordAttempt(attempt *api.Attempt) bool {
+	attempt.Epoch = time.Now().Unix()
+
+	t.Attempts++
+	t.AttemptHistory = append(t.AttemptHistory, attempt)
+
+	return t.Attempts < t.maxAttempts()
+}
+
+// forgetAttempt undoes the last recordAttempt, if it couldn't be stored.
+func (t *Task) forgetAttempt() {
+	t.Attempts--
+	t.AttemptHistory = t.AttemptHistory[:len(t.AttemptHistory)-1]
+}
+
+// requeue marks the Task as "queued" in etcd, not to be run before its retry backoff has elapsed.
+func (t *Task) requeue(ctx context.Context, client clientv3.KV) error {
+	var notBefore int64
+	if backoff := t.retryBackoff(); backoff > 0 {
+		notBefore = time.Now().Add(backoff).Unix()
+	}
+
+	return t.setStatus(ctx, client, &api.TaskStatus{&api.TaskStatus_Queued_{&api.TaskStatus_Queued{notBefore}}})
+}
+
+// retry records a failed attempt at running the Task on nodeID due to err, and requeues it.
+// If the Task has run out of attempts, it is marked as failed with err instead. The attempt is only kept if that succeeds.
+func (t *Task) retry(ctx context.Context, client clientv3.KV, nodeID *api.NodeID, err error) error {
+	var storeErr error
+	if t.recordAttempt(&api.Attempt{NodeId: nodeID, Outcome: &api.Attempt_Error{err.Error()}}) {
+		storeErr = t.requeue(ctx, client)
+	} else {
+		storeErr = t.fail(ctx, client, err)
+	}
+
+	if storeErr != nil {
+		t.forgetAttempt()
+	}
+
+	return storeErr
+}
+
+// retryExitCode records an attempt at running the Task on nodeID that exited with a retryable exitCode, and requeues it.
+// If the Task has run out of attempts, it is marked as complete with exitCode and usage instead. The attempt is only kept if that succeeds.
+func (t *Task) retryExitCode(ctx context.Context, client clientv3.KV, nodeID *api.NodeID, exitCode int, usage *api.ResourceUsage) error {
+	var err error
+	if t.recordAttempt(&api.Attempt{NodeId: nodeID, Outcome: &api.Attempt_ExitCode{int32(exitCode)}}) {
+		err = t.requeue(ctx, client)
+	} else {
+		err = t.complete(ctx, client, nodeID, exitCode, usage)
+	}
+
+	// The attempt is recorded again if the caller retries the task
+	if err != nil {
+		t.forgetAttempt()
+	}
+
+	return err
 }
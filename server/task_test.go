@@ -2,8 +2,12 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/coreos/etcd/mvcc/mvccpb"
+
+	"github.com/arthurfabre/scheduler/api"
+	"github.com/arthurfabre/scheduler/server/pb"
 )
 
 // TestTaskID tests task key handling
@@ -18,6 +22,176 @@ func TestTaskID(t *testing.T) {
 	}
 }
 
+// TestRunningNodeID tests running status key handling
+func TestRunningNodeID(t *testing.T) {
+	node := &api.NodeID{Uuid: "bar"}
+	key := idKey(runningPrefix(node), &api.TaskID{Uuid: "foo"})
+
+	id := runningNodeID(key)
+	if id.Uuid != node.Uuid {
+		t.Errorf("runningNodeID(%s) = %s, expected %s", key, id.Uuid, node.Uuid)
+	}
+}
+
+// TestNextBackoff tests backoff growth is capped
+func TestNextBackoff(t *testing.T) {
+	backoff := minBackoff
+	for i := 0; i < 100; i++ {
+		next := nextBackoff(backoff)
+		if next < backoff || next > maxBackoff {
+			t.Fatalf("nextBackoff(%v) = %v, expected between %v and %v", backoff, next, backoff, maxBackoff)
+		}
+		backoff = next
+	}
+
+	if backoff != maxBackoff {
+		t.Errorf("backoff never reached %v, got %v", maxBackoff, backoff)
+	}
+}
+
+// TestCheckResources tests resource limit validation
+func TestCheckResources(t *testing.T) {
+	valid := []*api.Resources{
+		nil,
+		{},
+		{CpuShares: 512, CpuMillis: 500, MemoryBytes: 1 << 30, Pids: 64},
+		{CpuMillis: 10},
+	}
+	for _, res := range valid {
+		if err := checkResources(res); err != nil {
+			t.Errorf("checkResources(%v) = %v, expected no error", res, err)
+		}
+	}
+
+	invalid := []*api.Resources{
+		{CpuShares: 1},
+		{CpuMillis: 1},
+		{CpuMillis: 9},
+		{MemoryBytes: 1 << 63},
+		{Pids: 1 << 63},
+	}
+	for _, res := range invalid {
+		if err := checkResources(res); err == nil {
+			t.Errorf("checkResources(%v) returned no error", res)
+		}
+	}
+}
+
+// TestCheckFailedStatus tests failed statuses require an epoch
+func TestCheckFailedStatus(t *testing.T) {
+	status := &api.TaskStatus{&api.TaskStatus_Failed_{&api.TaskStatus_Failed{Error: "foo"}}}
+	if err := checkTaskStatus(status); err == nil {
+		t.Errorf("Expected error checking failed status without epoch")
+	}
+
+	status.GetFailed().Epoch = 1
+	if err := checkTaskStatus(status); err != nil {
+		t.Errorf("Unexpected error checking failed status: %v", err)
+	}
+}
+
+// TestCheckTimedOutStatus tests timed out statuses require a node and an epoch
+func TestCheckTimedOutStatus(t *testing.T) {
+	status := &api.TaskStatus{&api.TaskStatus_TimedOut_{&api.TaskStatus_TimedOut{ElapsedSeconds: 10}}}
+	if err := checkTaskStatus(status); err == nil {
+		t.Errorf("Expected error checking timed out status without node")
+	}
+
+	status.GetTimedOut().NodeId = &api.NodeID{Uuid: "foo", Ip: "127.0.0.1", Port: 1234}
+	if err := checkTaskStatus(status); err == nil {
+		t.Errorf("Expected error checking timed out status without epoch")
+	}
+
+	status.GetTimedOut().Epoch = 1
+	if err := checkTaskStatus(status); err != nil {
+		t.Errorf("Unexpected error checking timed out status: %v", err)
+	}
+}
+
+// TestCheckEnv tests environment variables must be KEY=VALUE
+func TestCheckEnv(t *testing.T) {
+	if err := checkEnv([]string{"FOO=bar", "EMPTY=", "EQUALS=a=b"}); err != nil {
+		t.Errorf("Unexpected error checking env: %v", err)
+	}
+
+	for _, v := range []string{"FOO", "=bar", "FOO=b\x00ar"} {
+		if err := checkEnv([]string{v}); err == nil {
+			t.Errorf("Expected error checking env variable %q", v)
+		}
+	}
+}
+
+// TestCheckUser tests users must be user, uid, user:group or uid:gid
+func TestCheckUser(t *testing.T) {
+	for _, user := range []string{"", "nobody", "1000", "nobody:nogroup", "1000:1000"} {
+		if err := checkUser(user); err != nil {
+			t.Errorf("Unexpected error checking user %q: %v", user, err)
+		}
+	}
+
+	for _, user := range []string{":", "nobody:", ":1000", "a:b:c", "no body"} {
+		if err := checkUser(user); err == nil {
+			t.Errorf("Expected error checking user %q", user)
+		}
+	}
+}
+
+// TestCheckImageName tests image names must be [registry[:port]/]repository[:tag]
+func TestCheckImageName(t *testing.T) {
+	for _, name := range []string{"busybox", "busybox:latest", "library/busybox:1.28", "registry:5000/foo:tag", "registry.example.com/foo/bar"} {
+		if err := checkImageName(name); err != nil {
+			t.Errorf("Unexpected error checking image name %q: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", "Busybox", "/busybox", "busybox/", "foo//bar", "foo:tag/bar", "foo:"} {
+		if err := checkImageName(name); err == nil {
+			t.Errorf("Expected error checking image name %q", name)
+		}
+	}
+}
+
+// TestRetryBackoff tests retry backoff doubles between attempts, up to its maximum
+func TestRetryBackoff(t *testing.T) {
+	task := &Task{Task: &pb.Task{Request: &api.TaskRequest{Retry: &api.RetryPolicy{BackoffSeconds: 10, MaxBackoffSeconds: 60}}}}
+
+	for attempts, expected := range []time.Duration{0, 10 * time.Second, 20 * time.Second, 40 * time.Second, 60 * time.Second, 60 * time.Second} {
+		task.Attempts = uint32(attempts)
+		if backoff := task.retryBackoff(); backoff != expected {
+			t.Errorf("retryBackoff() after %d attempts = %v, expected %v", attempts, backoff, expected)
+		}
+	}
+
+	// Large attempts shouldn't overflow without a maximum
+	task.Request.Retry.MaxBackoffSeconds = 0
+	task.Attempts = 100
+	if backoff := task.retryBackoff(); backoff <= 0 {
+		t.Errorf("retryBackoff() after %d attempts = %v, expected positive backoff", task.Attempts, backoff)
+	}
+}
+
+// TestRecordAttempt tests tasks can only be retried until they run out of attempts
+func TestRecordAttempt(t *testing.T) {
+	task := &Task{Task: &pb.Task{Request: &api.TaskRequest{}}}
+
+	for i := 1; i <= defaultMaxAttempts; i++ {
+		retry := task.recordAttempt(&api.Attempt{})
+		if retry != (i < defaultMaxAttempts) {
+			t.Errorf("recordAttempt() on attempt %d = %v", i, retry)
+		}
+	}
+
+	if len(task.AttemptHistory) != defaultMaxAttempts {
+		t.Errorf("Expected %d attempts in history, got %d", defaultMaxAttempts, len(task.AttemptHistory))
+	}
+
+	// Attempts that couldn't be stored can be recorded again
+	task.forgetAttempt()
+	if task.Attempts != defaultMaxAttempts-1 || len(task.AttemptHistory) != defaultMaxAttempts-1 {
+		t.Errorf("Expected %d attempts after forgetting one, got %d (%d in history)", defaultMaxAttempts-1, task.Attempts, len(task.AttemptHistory))
+	}
+}
+
 // TestStatus
 
 // TestParseTask tests task parsing